@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/zmap/zgrab/ztools/x509"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	maxAiaDepth      = 4
+	maxAiaSize       = 64 * 1024
+	aiaFailureExpiry = time.Hour // failed URLs are not fetched again meanwhile
+)
+
+var (
+	oidPkcs7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+	// Shared address space for carrier-grade NAT (RFC 6598)
+	sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+)
+
+// ContentInfo of a PKCS#7 message (RFC 2315)
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// SignedData of a PKCS#7 message, certs-only messages have no signers
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+// A failed fetch
+type aiaFailure struct {
+	err     error
+	expires time.Time
+}
+
+// A running fetch, other routines wait for it
+type aiaFetch struct {
+	certs []*x509.Certificate
+	err   error
+	sync.WaitGroup
+}
+
+// Fetches missing intermediate certificates from the
+// Authority Information Access URL of the issued certificate.
+type AiaFetcher struct {
+	client     *http.Client
+	cacheDir   string // optional, fetched certificates are stored here
+	publicOnly bool   // refuse to connect to loopback, private and link-local addresses
+
+	// maps from URL to certificates, failure and running fetch
+	cache    map[string][]*x509.Certificate
+	failures map[string]*aiaFailure
+	running  map[string]*aiaFetch
+	sync.Mutex
+}
+
+func NewAiaFetcher(cacheDir string, timeout time.Duration) *AiaFetcher {
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			panic(err)
+		}
+	}
+
+	fetcher := &AiaFetcher{
+		cacheDir:   cacheDir,
+		publicOnly: true,
+		cache:      make(map[string][]*x509.Certificate),
+		failures:   make(map[string]*aiaFailure),
+		running:    make(map[string]*aiaFetch),
+	}
+
+	// The URLs are taken from the certificates of the scanned hosts.
+	// The address is checked after resolving, redirects included.
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); fetcher.publicOnly && (ip == nil || !isPublicAddress(ip)) {
+				return errors.New("AIA URL with a non-public address: " + host)
+			}
+			return nil
+		},
+	}
+	fetcher.client = &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+
+	return fetcher
+}
+
+// Is the address reachable from the internet?
+func isPublicAddress(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// Follows the issuers of the server certificate and adds the
+// fetched certificates to the pool. Returns true if any certificate
+// has been fetched.
+func (fetcher *AiaFetcher) FetchMissing(certs []*x509.Certificate, pool *x509.CertPool) bool {
+	subjects := make(map[string]*x509.Certificate)
+	for _, cert := range certs {
+		subjects[string(cert.RawSubject)] = cert
+	}
+
+	fetched := false
+	current := certs[0]
+
+	for depth := 0; depth < maxAiaDepth; depth++ {
+		// Self-signed?
+		if string(current.RawIssuer) == string(current.RawSubject) {
+			break
+		}
+
+		// Issuer sent by the server?
+		if issuer, ok := subjects[string(current.RawIssuer)]; ok {
+			current = issuer
+			continue
+		}
+
+		if len(current.IssuingCertificateURL) == 0 {
+			break
+		}
+
+		fetchedCerts, err := fetcher.Fetch(current.IssuingCertificateURL[0])
+		if err != nil {
+			break
+		}
+
+		// PKCS#7 bundles may contain more than the issuer
+		for _, cert := range fetchedCerts {
+			pool.AddCert(cert)
+			subjects[string(cert.RawSubject)] = cert
+			fetched = true
+		}
+
+		issuer, ok := subjects[string(current.RawIssuer)]
+		if !ok {
+			break
+		}
+		current = issuer
+	}
+
+	return fetched
+}
+
+// Returns the certificates from the cache or downloads them.
+// Concurrent fetches of the same URL are only downloaded once.
+func (fetcher *AiaFetcher) Fetch(url string) ([]*x509.Certificate, error) {
+	fetcher.Lock()
+	if certs, ok := fetcher.cache[url]; ok {
+		fetcher.Unlock()
+		return certs, nil
+	}
+	if failure, ok := fetcher.failures[url]; ok {
+		if time.Now().Before(failure.expires) {
+			fetcher.Unlock()
+			return nil, failure.err
+		}
+		delete(fetcher.failures, url)
+	}
+	if fetch, ok := fetcher.running[url]; ok {
+		fetcher.Unlock()
+		fetch.Wait()
+		return fetch.certs, fetch.err
+	}
+	fetch := &aiaFetch{}
+	fetch.Add(1)
+	fetcher.running[url] = fetch
+	fetcher.Unlock()
+
+	fetch.certs, fetch.err = fetcher.fetch(url)
+
+	fetcher.Lock()
+	if fetch.err == nil {
+		fetcher.cache[url] = fetch.certs
+	} else {
+		fetcher.failures[url] = &aiaFailure{err: fetch.err, expires: time.Now().Add(aiaFailureExpiry)}
+	}
+	delete(fetcher.running, url)
+	fetcher.Unlock()
+	fetch.Done()
+
+	// Store the certificates in the database
+	if fetch.err == nil && resultProcessor != nil {
+		for _, cert := range fetch.certs {
+			resultProcessor.Add(cert)
+		}
+	}
+
+	return fetch.certs, fetch.err
+}
+
+// Reads the certificates from the cache directory or downloads them
+func (fetcher *AiaFetcher) fetch(url string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	var path string
+	var raw []byte
+	var err error
+
+	// Try the cache directory
+	if fetcher.cacheDir != "" {
+		sum := sha1.Sum([]byte(url))
+		path = filepath.Join(fetcher.cacheDir, hex.EncodeToString(sum[:])+".der")
+		raw, _ = ioutil.ReadFile(path)
+	}
+
+	if raw == nil {
+		if raw, err = fetcher.download(url); err != nil {
+			return nil, err
+		}
+	}
+
+	// Some servers deliver PEM instead of DER
+	if block, _ := pem.Decode(raw); block != nil {
+		raw = block.Bytes
+	}
+
+	if certs, err = parseAiaCertificates(raw); err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		if err = ioutil.WriteFile(path, raw, 0644); err != nil {
+			log.Println("Unable to cache intermediate certificate:", err)
+		}
+	}
+
+	return certs, nil
+}
+
+func (fetcher *AiaFetcher) download(rawURL string) ([]byte, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, errors.New("unsupported AIA URL scheme: " + parsed.Scheme)
+	}
+
+	response, err := fetcher.client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status: " + response.Status)
+	}
+
+	raw, err := ioutil.ReadAll(&io.LimitedReader{R: response.Body, N: maxAiaSize + 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxAiaSize {
+		return nil, errors.New("AIA response too large: " + rawURL)
+	}
+	return raw, nil
+}
+
+// Parses a DER encoded certificate (application/pkix-cert)
+// or a certs-only PKCS#7 message (application/pkcs7-mime)
+func parseAiaCertificates(raw []byte) ([]*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(raw)
+	if err == nil {
+		return []*x509.Certificate{cert}, nil
+	}
+
+	var contentInfo pkcs7ContentInfo
+	if _, perr := asn1.Unmarshal(raw, &contentInfo); perr != nil || !contentInfo.ContentType.Equal(oidPkcs7SignedData) {
+		// Report the error of the more common format
+		return nil, err
+	}
+
+	var signedData pkcs7SignedData
+	if _, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return nil, err
+	}
+
+	certs, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("PKCS#7 message without certificates")
+	}
+	return certs, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Allows the fetcher to connect to the loopback address of the test server
+func newTestAiaFetcher(cacheDir string) *AiaFetcher {
+	fetcher := NewAiaFetcher(cacheDir, time.Second)
+	fetcher.publicOnly = false
+	return fetcher
+}
+
+func TestAiaFetcherCache(t *testing.T) {
+	pemBytes, _ := ioutil.ReadFile("testdata/example.com.crt")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(pemBytes)
+	}))
+	url := server.URL + "/ca.crt"
+
+	cacheDir, _ := ioutil.TempDir("", "aia")
+	defer os.RemoveAll(cacheDir)
+
+	certs, err := newTestAiaFetcher(cacheDir).Fetch(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	// The certificate must be read from the cache directory
+	cached, err := newTestAiaFetcher(cacheDir).Fetch(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 1 || string(cached[0].Raw) != string(certs[0].Raw) {
+		t.Fatal("cached certificate differs")
+	}
+}
+
+func TestAiaFetcherFailure(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	url := server.URL + "/ca.crt"
+
+	fetcher := newTestAiaFetcher("")
+	for i := 0; i < 3; i++ {
+		if _, err := fetcher.Fetch(url); err == nil {
+			t.Fatal("error expected")
+		}
+	}
+
+	// The failure must be cached
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatal("unexpected number of requests:", n)
+	}
+}
+
+func TestAiaFetcherRestrictions(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write(make([]byte, maxAiaSize+1))
+	}))
+	defer server.Close()
+
+	// Loopback addresses are refused before connecting
+	if _, err := NewAiaFetcher("", time.Second).Fetch(server.URL + "/ca.crt"); err == nil || !strings.Contains(err.Error(), "non-public") {
+		t.Fatal("loopback address accepted:", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatal("unexpected number of requests:", n)
+	}
+
+	if _, err := newTestAiaFetcher("").Fetch("file:///etc/passwd"); err == nil {
+		t.Fatal("file URL accepted")
+	}
+	if _, err := newTestAiaFetcher("").Fetch(server.URL + "/large.crt"); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatal("large response accepted:", err)
+	}
+}
+
+func TestParseAiaCertificates(t *testing.T) {
+	pemBytes, _ := ioutil.ReadFile("testdata/example.com.crt")
+	block, _ := pem.Decode(pemBytes)
+
+	// A certs-only PKCS#7 message like the ones of .p7c URLs
+	emptySet := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+		Certificates     asn1.RawValue
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo:      struct{ ContentType asn1.ObjectIdentifier }{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: block.Bytes},
+		SignerInfos:      emptySet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidPkcs7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, raw := range [][]byte{block.Bytes, message} {
+		certs, err := parseAiaCertificates(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != 1 || string(certs[0].Raw) != string(block.Bytes) {
+			t.Fatal("unexpected certificates:", certs)
+		}
+	}
+
+	if _, err := parseAiaCertificates([]byte("garbage")); err == nil {
+		t.Fatal("garbage accepted")
+	}
+}
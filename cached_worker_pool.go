@@ -2,6 +2,7 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -9,8 +10,20 @@ type CacheConfig struct {
 	ExpireAfter   time.Duration
 	RefreshAfter  time.Duration
 	CheckInterval time.Duration
+
+	// Policies for outcomes that differ from the default
+	Outcomes map[string]*CachePolicy
+}
+
+// Expiry and refresh durations of an outcome
+type CachePolicy struct {
+	ExpireAfter  time.Duration
+	RefreshAfter time.Duration
 }
 
+// Returns the outcome of a processed entry, an empty string for the default policy
+type OutcomeFunc func(entry *CacheEntry) string
+
 type CacheEntry struct {
 	Key   string      `json:"-"`
 	Value interface{} `json:"value"`
@@ -18,6 +31,12 @@ type CacheEntry struct {
 	// Is the entry currently enqueued or beeing processed?
 	Pending bool `json:"pending"`
 
+	// Number of retries after transient errors
+	Retries uint `json:"retries"`
+
+	// Selects the cache policy
+	Outcome string `json:"outcome,omitempty"`
+
 	// Cache attributes
 	Hits      uint64    `json:"hits"`
 	Created   time.Time `json:"created"`
@@ -47,6 +66,21 @@ type CachedWorkerPool struct {
 	workers    *WorkerPool
 	workerFunc WorkerFunc
 
+	// Optional, decides the cache policy of processed entries
+	outcomeFunc OutcomeFunc
+
+	// Optional admission control. A rejected entry must be added again with requeue.
+	admit   func(entry *CacheEntry) bool
+	release func(entry *CacheEntry)
+
+	// Optional, called when an entry has been removed from the cache
+	expired func(key string)
+
+	// Scheduled retries
+	retriesPending int32
+	retriesClosed  bool
+	retriesLock    sync.RWMutex
+
 	// mutex for the cache
 	sync.Mutex
 }
@@ -59,6 +93,29 @@ func NewCacheConfig(expireAfter uint, refreshAfter uint, checkInterval uint) *Ca
 		ExpireAfter:   time.Duration(expireAfter) * time.Second,
 		RefreshAfter:  time.Duration(refreshAfter) * time.Second,
 		CheckInterval: time.Duration(checkInterval) * time.Second,
+		Outcomes:      make(map[string]*CachePolicy),
+	}
+}
+
+// Adds a policy for entries with the given outcome
+func (config *CacheConfig) AddOutcome(outcome string, expireAfter uint, refreshAfter uint) {
+	if expireAfter == 0 {
+		panic("expireAfter must not be zero")
+	}
+	config.Outcomes[outcome] = &CachePolicy{
+		ExpireAfter:  time.Duration(expireAfter) * time.Second,
+		RefreshAfter: time.Duration(refreshAfter) * time.Second,
+	}
+}
+
+// Returns the policy of the outcome or the default policy
+func (config *CacheConfig) policy(outcome string) *CachePolicy {
+	if policy, ok := config.Outcomes[outcome]; ok {
+		return policy
+	}
+	return &CachePolicy{
+		ExpireAfter:  config.ExpireAfter,
+		RefreshAfter: config.RefreshAfter,
 	}
 }
 
@@ -122,11 +179,116 @@ func (proc *CachedWorkerPool) NewJob(key string, accessed time.Time) (entry *Cac
 	return entry
 }
 
+// Stores a value computed elsewhere unless the entry is pending.
+// Does nothing if the cache is disabled.
+func (proc *CachedWorkerPool) Set(key string, value interface{}) {
+	if proc.cacheConfig == nil {
+		return
+	}
+	now := time.Now()
+
+	proc.Lock()
+	defer proc.Unlock()
+
+	entry, exist := proc.cache[key]
+	if exist && entry.Pending {
+		return
+	}
+	if !exist {
+		entry = &CacheEntry{
+			Key:      key,
+			Created:  now,
+			Accessed: now,
+		}
+		proc.cache[key] = entry
+	}
+	entry.Value = value
+	entry.Refreshed = now
+}
+
+// Returns the value of a finished entry, nil otherwise
+func (proc *CachedWorkerPool) Get(key string) interface{} {
+	proc.Lock()
+	defer proc.Unlock()
+
+	if entry, exist := proc.cache[key]; exist && !entry.Pending {
+		return entry.Value
+	}
+	return nil
+}
+
+// Enqueues a finished entry again to recompute its value.
+// Creates the entry if it does not exist.
+func (proc *CachedWorkerPool) Refresh(key string) *CacheEntry {
+	proc.Lock()
+	entry, exist := proc.cache[key]
+	enqueue := exist && !entry.Pending
+	if enqueue {
+		entry.Pending = true
+		entry.Add(1)
+	}
+	proc.Unlock()
+
+	if !exist {
+		return proc.NewJob(key, time.Now())
+	}
+	if enqueue {
+		proc.workers.Add(entry)
+	}
+	return entry
+}
+
+// Adds a deferred entry again without blocking the caller
+func (proc *CachedWorkerPool) requeue(entry *CacheEntry) {
+	go proc.workers.Add(entry)
+}
+
+// Enqueues the entry again after the delay unless it has been
+// removed from the cache or enqueued otherwise in the meantime.
+func (proc *CachedWorkerPool) RetryAfter(entry *CacheEntry, delay time.Duration) {
+	atomic.AddInt32(&proc.retriesPending, 1)
+
+	time.AfterFunc(delay, func() {
+		proc.retriesLock.RLock()
+		defer proc.retriesLock.RUnlock()
+		defer atomic.AddInt32(&proc.retriesPending, -1)
+
+		if proc.retriesClosed {
+			return
+		}
+
+		proc.Lock()
+		enqueue := !entry.Pending && (proc.cacheConfig == nil || proc.cache[entry.Key] == entry)
+		if enqueue {
+			entry.Pending = true
+			entry.Add(1)
+		}
+		proc.Unlock()
+
+		if enqueue {
+			proc.workers.Add(entry)
+		}
+	})
+}
+
+// Waits until the scheduled retries have been processed
+func (proc *CachedWorkerPool) waitRetries() {
+	for atomic.LoadInt32(&proc.retriesPending) > 0 || len(proc.workers.channel) > 0 || atomic.LoadUint32(&proc.workers.processing) > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Drop retries scheduled from now on
+	proc.retriesLock.Lock()
+	proc.retriesClosed = true
+	proc.retriesLock.Unlock()
+}
+
 // Stops accepting new entrys and waits until all entrys are finished
 func (proc *CachedWorkerPool) Close() {
 	if proc.cacheChannel != nil {
 		close(proc.cacheChannel)
 	}
+	proc.waitRetries()
 	proc.workers.Close()
 }
 
@@ -134,48 +296,69 @@ func (proc *CachedWorkerPool) Close() {
 func (proc *CachedWorkerPool) work(item interface{}) {
 	entry, _ := item.(*CacheEntry)
 
+	// Deferred by the admission control?
+	if proc.admit != nil && !proc.admit(entry) {
+		return
+	}
+
 	// Call the worker function and save the return value
 	proc.workerFunc(entry)
 
+	if proc.outcomeFunc != nil {
+		entry.Outcome = proc.outcomeFunc(entry)
+	}
+
+	if proc.release != nil {
+		proc.release(entry)
+	}
+
 	// Lock
 	proc.Lock()
 
 	// Expire the entry immediately?
-	if proc.cacheConfig == nil {
+	expire := proc.cacheConfig == nil
+	if expire {
 		delete(proc.cache, entry.Key)
 	}
 
 	// Unlock
 	proc.Unlock()
 
+	if expire && proc.expired != nil {
+		proc.expired(entry.Key)
+	}
+
 	// Mark as finished and wake up waiting routines
 	entry.Refreshed = time.Now()
 	entry.Pending = false
 	entry.Done()
 }
 
-func (config *CacheConfig) shouldExpire(accessed time.Time) bool {
-	return time.Since(accessed) > config.ExpireAfter
+func (policy *CachePolicy) shouldExpire(accessed time.Time) bool {
+	return time.Since(accessed) > policy.ExpireAfter
 }
 
-func (config *CacheConfig) shouldRefresh(refreshed time.Time) bool {
-	return config.RefreshAfter > 0 && time.Since(refreshed) > config.RefreshAfter
+func (policy *CachePolicy) shouldRefresh(refreshed time.Time) bool {
+	return policy.RefreshAfter > 0 && time.Since(refreshed) > policy.RefreshAfter
 }
 
 // Periodically checks the cache and expires oder enqueues entries.
 func (proc *CachedWorkerPool) cacheWorker() {
 	for range proc.cacheChannel {
 		enqueue := make([]*CacheEntry, 0)
+		expired := make([]string, 0)
 
 		proc.CacheWorkerStarted = time.Now()
 		proc.Lock()
 		for key, entry := range proc.cache {
 			if !entry.Pending {
-				if proc.cacheConfig.shouldExpire(entry.Accessed) {
+				policy := proc.cacheConfig.policy(entry.Outcome)
+				if policy.shouldExpire(entry.Accessed) {
 					// expire the entry
 					delete(proc.cache, key)
+					expired = append(expired, key)
 					proc.CacheExpiries++
-				} else if proc.cacheConfig.shouldRefresh(entry.Refreshed) {
+				} else if policy.shouldRefresh(entry.Refreshed) {
 					// enqueue the entry
 					entry.Pending = true
 					entry.Add(1)
@@ -186,6 +369,12 @@ func (proc *CachedWorkerPool) cacheWorker() {
 		proc.Unlock()
 		proc.CacheWorkerStopped = time.Now()
 
+		if proc.expired != nil {
+			for _, key := range expired {
+				proc.expired(key)
+			}
+		}
+
 		// Update refreshes counter
 		proc.CacheRefreshes += uint64(len(enqueue))
 
@@ -7,14 +7,27 @@ import (
 	"time"
 )
 
+var (
+	certificateRoots *x509.CertPool // trusted roots, the system roots if nil
+)
+
 type CertificateValidity struct {
 	Expired       bool // Expiration of the server certificate
+	Incomplete    bool // The server has not sent all intermediates
 	Error         error
 	Certificates  []*x509.Certificate            // the first is the server certificate
 	TrustedChains map[string][]*x509.Certificate // map from trusted root store to chain
+	SCTs          int                            // Number of valid signed certificate timestamps
+	SCTOperators  int                            // Number of distinct operators of the logs
 }
 
-func NewCertificateValidity(certs []*x509.Certificate) *CertificateValidity {
+// Validates the certificates and the SCTs received via the TLS extension
+func NewCertificateValidity(certs []*x509.Certificate, tlsSCTs [][]byte) *CertificateValidity {
+	return NewCertificateValidityAt(certs, tlsSCTs, time.Now())
+}
+
+// Validates the certificates at the given time
+func NewCertificateValidityAt(certs []*x509.Certificate, tlsSCTs [][]byte, at time.Time) *CertificateValidity {
 	v := &CertificateValidity{
 		Certificates:  certs,
 		TrustedChains: make(map[string][]*x509.Certificate),
@@ -23,9 +36,12 @@ func NewCertificateValidity(certs []*x509.Certificate) *CertificateValidity {
 	var leaf *x509.Certificate
 
 	opts := x509.VerifyOptions{
-		CurrentTime:   time.Now(),
+		CurrentTime:   at,
 		Intermediates: x509.NewCertPool(),
-		Roots:         x509.SystemRootsPool(),
+		Roots:         certificateRoots,
+	}
+	if opts.Roots == nil {
+		opts.Roots = x509.SystemRootsPool()
 	}
 
 	for i, cert := range certs {
@@ -39,14 +55,28 @@ func NewCertificateValidity(certs []*x509.Certificate) *CertificateValidity {
 	// Check expiration
 	v.Expired = opts.CurrentTime.Before(leaf.NotBefore) || opts.CurrentTime.After(leaf.NotAfter)
 
+	// Verify signed certificate timestamps
+	if ctLogs != nil {
+		v.verifySCTs(tlsSCTs)
+	}
+
 	// Check for unhandled critical extensions
 	if len(leaf.UnhandledCriticalExtensions) > 0 {
 		v.Error = errors.New("unhandled critical extension")
 		return v
 	}
 
+	// Judged by the sent certificates, AIA fetching only helps the trust
+	v.Incomplete = chainIncomplete(certs, opts.Roots)
+
 	// Build chains to root certificates
 	candidateChains, err := leaf.BuildChains(&opts)
+
+	// Fetch missing intermediates and try again
+	if err != nil && aiaFetcher != nil && aiaFetcher.FetchMissing(certs, opts.Intermediates) {
+		candidateChains, err = leaf.BuildChains(&opts)
+	}
+
 	if err != nil {
 		v.Error = err
 		return v
@@ -69,6 +99,74 @@ func NewCertificateValidity(certs []*x509.Certificate) *CertificateValidity {
 	return v
 }
 
+// Follows the issuers within the sent certificates. The chain is incomplete
+// if it ends before a self-signed certificate or a certificate issued by a root.
+// Without the issuer, a missing intermediate looks like an unknown root.
+func chainIncomplete(certs []*x509.Certificate, roots *x509.CertPool) bool {
+	subjects := make(map[string]*x509.Certificate)
+	for _, cert := range certs {
+		subjects[string(cert.RawSubject)] = cert
+	}
+	for _, subject := range roots.Subjects() {
+		subjects[string(subject)] = nil
+	}
+
+	current := certs[0]
+	for range certs {
+		if string(current.RawIssuer) == string(current.RawSubject) {
+			return false
+		}
+		issuer, ok := subjects[string(current.RawIssuer)]
+		if !ok {
+			return true
+		}
+		if issuer == nil {
+			// issued by a root
+			return false
+		}
+		current = issuer
+	}
+
+	// A loop of cross-signed certificates
+	return false
+}
+
+// Counts the valid SCTs and the operators of their logs
+func (v *CertificateValidity) verifySCTs(tlsSCTs [][]byte) {
+	leaf := v.Certificates[0]
+	operators := mapset.NewThreadUnsafeSet()
+
+	check := func(raw []byte, entryType uint16, entry []byte) {
+		sct, err := ParseSCT(raw)
+		if err != nil {
+			return
+		}
+		if ctLog, err := ctLogs.Verify(sct, entryType, entry); err == nil {
+			v.SCTs++
+			operators.Add(ctLog.Operator)
+		}
+	}
+
+	// SCTs from the TLS extension refer to the certificate itself
+	entry := ctX509Entry(leaf)
+	for _, raw := range tlsSCTs {
+		check(raw, ctEntryTypeX509, entry)
+	}
+
+	// Embedded SCTs refer to the precertificate and require the issuer
+	if len(v.Certificates) > 1 {
+		if embedded, err := embeddedSCTs(leaf); err == nil && len(embedded) > 0 {
+			if entry, err = ctPrecertEntry(leaf, v.Certificates[1]); err == nil {
+				for _, raw := range embedded {
+					check(raw, ctEntryTypePrecert, entry)
+				}
+			}
+		}
+	}
+
+	v.SCTOperators = operators.Cardinality()
+}
+
 // Names of trusted root stores
 func (v *CertificateValidity) TrustedNames() mapset.Set {
 	set := mapset.NewThreadUnsafeSet()
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/zmap/zgrab/ztools/x509"
+	"testing"
+	"time"
+)
+
+func TestChainIncomplete(t *testing.T) {
+	chain := newFakeChain(t, time.Now().Add(24*time.Hour), "mx.example.test")
+	certs := make([]*x509.Certificate, 0)
+	for _, raw := range chain.certificate.Certificate {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	root, _ := x509.ParseCertificate(chain.root.Raw)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	if chainIncomplete(certs, roots) {
+		t.Fatal("complete chain taken as incomplete")
+	}
+	if !chainIncomplete(certs[:1], roots) {
+		t.Fatal("missing intermediate not detected")
+	}
+	if chainIncomplete(append(certs, root), x509.NewCertPool()) {
+		t.Fatal("chain with a self-signed root taken as incomplete")
+	}
+
+	// Without AIA fetching, the intermediate is not found
+	validity := NewCertificateValidity(certs[:1], nil)
+	if !validity.Incomplete {
+		t.Fatal("missing intermediate not detected")
+	}
+}
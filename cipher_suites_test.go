@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWeakCipherSuite(t *testing.T) {
+	// TLS_RSA_WITH_RC4_128_SHA
+	if !isWeakCipherSuite(0x0005) {
+		t.Fatal("RC4 should be weak")
+	}
+
+	// TLS_RSA_WITH_NULL_MD5
+	if !isWeakCipherSuite(0x0001) {
+		t.Fatal("NULL should be weak")
+	}
+
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	if isWeakCipherSuite(0xc02f) {
+		t.Fatal("AES-GCM should not be weak")
+	}
+}
+
+func TestLegacyCipherSuitesOrder(t *testing.T) {
+	suites := legacyCipherSuites()
+	for i := 1; i < len(suites); i++ {
+		if suites[i-1] >= suites[i] {
+			t.Fatal("unexpected order:", suites)
+		}
+		if suites[i]>>8 == 0x13 {
+			t.Fatal("TLS 1.3 suite offered:", suites[i])
+		}
+	}
+}
@@ -7,10 +7,13 @@ import (
 	"encoding/pem"
 	"errors"
 	"github.com/zmap/zgrab/ztools/x509"
+	"io"
 	"net"
+	"time"
 )
 
-func processCommand(command string, input *bufio.Scanner, output *bufio.Writer) error {
+func processCommand(command string, reader io.Reader, output *bufio.Writer) error {
+	input := bufio.NewScanner(reader)
 
 	var str []byte
 	var err error
@@ -28,8 +31,16 @@ func processCommand(command string, input *bufio.Scanner, output *bufio.Writer)
 		}
 	case "import-addresses":
 		for input.Scan() {
-			hostProcessor.NewJob(net.ParseIP(input.Text()))
+			address := net.ParseIP(input.Text())
+			if address == nil || !familyAllowed(address) {
+				continue
+			}
+			for _, port := range hostPorts {
+				hostProcessor.NewJobWithAccessTime(&ScanTarget{Address: address, Port: port}, time.Now())
+			}
 		}
+	case "import-zgrab":
+		err = importZgrabFile(reader, output)
 	case "import-certificates":
 		// Read input to buffer
 		buffer := new(bytes.Buffer)
@@ -54,13 +65,21 @@ func processCommand(command string, input *bufio.Scanner, output *bufio.Writer)
 		output.Flush()
 	case "update-certificates":
 		updateCertificates()
+	case "reanalyze":
+		err = reanalyzeTranscripts(output)
+	case "revalidate":
+		revalidateMxHosts(validationTime)
 	case "resolve-mx":
 		resolveDomainMxHosts()
+	case "dual-stack":
+		str, err = mxProcessor.dualStackStatus()
+	case "inconsistent":
+		str, err = mxProcessor.inconsistentStatus()
 	case "cache-mx":
 		str, err = cacheStatus(mxProcessor.cache, nil)
 	case "cache-hosts":
 		converter := func(str string) string {
-			return net.IP(str).String()
+			return parseHostKey(str).String()
 		}
 		str, err = cacheStatus(hostProcessor.cache, converter)
 	default:
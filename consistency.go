@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/deckarep/golang-set"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Number of MX hostnames listed by the inconsistent command
+const maxInconsistentReports = 100
+
+// Verdicts of a ConsistencyReport
+const (
+	verdictConsistent   = "consistent"
+	verdictInconsistent = "inconsistent"
+)
+
+// Differences between the addresses of a MX hostname, e.g. behind a load balancer
+type ConsistencyReport struct {
+	Hostname    string              `json:"hostname"`
+	Verdict     string              `json:"verdict"`
+	Addresses   []string            `json:"addresses"`
+	Differences map[string][]string `json:"differences"` // addresses that differ from the majority, by aspect
+	Score       int                 `json:"score"`       // number of differing aspects over all addresses
+	Updated     time.Time           `json:"updated"`
+}
+
+// Compares the addresses of a MX hostname. Returns nil for a single address.
+func compareAddresses(hostname string, hosts []*MxHostSummary) *ConsistencyReport {
+	if len(hosts) < 2 {
+		return nil
+	}
+
+	report := &ConsistencyReport{
+		Hostname:    hostname,
+		Verdict:     verdictConsistent,
+		Addresses:   make([]string, len(hosts)),
+		Differences: make(map[string][]string),
+		Updated:     time.Now().UTC(),
+	}
+
+	// The values of each aspect by address
+	aspects := map[string]map[string]string{
+		"reachable":    make(map[string]string),
+		"starttls":     make(map[string]string),
+		"certificate":  make(map[string]string),
+		"trust":        make(map[string]string),
+		"tls-versions": make(map[string]string),
+	}
+
+	for i, host := range hosts {
+		address := host.address.String()
+		report.Addresses[i] = address
+
+		// A timeout or a 4xx greeting says nothing about the configuration
+		if host.IsTransientError() {
+			continue
+		}
+
+		if host.Starttls == nil {
+			aspects["reachable"][address] = "no"
+			continue
+		}
+		aspects["reachable"][address] = "yes"
+
+		if !*host.Starttls || len(host.certificates) == 0 {
+			aspects["starttls"][address] = "no"
+			continue
+		}
+		aspects["starttls"][address] = "yes"
+
+		if fingerprint := host.ServerFingerprint(); fingerprint != nil {
+			aspects["certificate"][address] = string(*fingerprint)
+		}
+		if host.validity != nil {
+			aspects["trust"][address] = sortedJoin(host.validity.TrustedNames())
+		}
+		if host.tlsVersions != nil {
+			aspects["tls-versions"][address] = sortedJoin(host.tlsVersions)
+		}
+	}
+
+	for aspect, values := range aspects {
+		if differing := minorityAddresses(values); len(differing) > 0 {
+			report.Differences[aspect] = differing
+			report.Score += len(differing)
+		}
+	}
+
+	if report.Score > 0 {
+		report.Verdict = verdictInconsistent
+	}
+	return report
+}
+
+// Returns the sorted addresses whose value differs from the most common one
+func minorityAddresses(values map[string]string) []string {
+	counts := make(map[string]int)
+	for _, value := range values {
+		counts[value]++
+	}
+	if len(counts) < 2 {
+		return nil
+	}
+
+	// Pick the majority, ties are broken by the lower value
+	var majority string
+	for value, count := range counts {
+		if count > counts[majority] || (count == counts[majority] && value < majority) {
+			majority = value
+		}
+	}
+
+	result := make([]string, 0)
+	for address, value := range values {
+		if value != majority {
+			result = append(result, address)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func sortedJoin(set mapset.Set) string {
+	items := setToStringArrays(set)
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// The differing aspects with their addresses, like "certificate=192.0.2.1"
+func (record *TxtRecord) Inconsistencies() []string {
+	if record.consistency == nil {
+		return nil
+	}
+	result := make([]string, 0)
+	for aspect, addresses := range record.consistency.Differences {
+		for _, address := range addresses {
+			result = append(result, aspect+"="+address)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// The verdict of the consistency check, empty for a single address
+func (record *TxtRecord) ConsistencyVerdict() string {
+	if record.consistency == nil {
+		return ""
+	}
+	return record.consistency.Verdict
+}
+
+// Remembers the latest report of an inconsistent MX hostname
+func (proc *MxProcessor) setConsistencyReport(hostname string, report *ConsistencyReport) {
+	proc.consistencyMutex.Lock()
+	defer proc.consistencyMutex.Unlock()
+
+	if report == nil || report.Verdict == verdictConsistent {
+		delete(proc.consistency, hostname)
+	} else {
+		proc.consistency[hostname] = report
+	}
+}
+
+// Returns the most inconsistent MX hostnames as JSON
+func (proc *MxProcessor) inconsistentStatus() ([]byte, error) {
+	proc.consistencyMutex.Lock()
+	reports := make([]*ConsistencyReport, 0, len(proc.consistency))
+	for _, report := range proc.consistency {
+		reports = append(reports, report)
+	}
+	proc.consistencyMutex.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Score != reports[j].Score {
+			return reports[i].Score > reports[j].Score
+		}
+		return reports[i].Hostname < reports[j].Hostname
+	})
+
+	if len(reports) > maxInconsistentReports {
+		reports = reports[:maxInconsistentReports]
+	}
+
+	return json.Marshal(reports)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCompareAddresses(t *testing.T) {
+	if report := compareAddresses("mx.example.com", []*MxHostSummary{dualStackHost("192.0.2.1", true, "\x03\x03")}); report != nil {
+		t.Fatal("a single address should not be compared")
+	}
+
+	report := compareAddresses("mx.example.com", []*MxHostSummary{
+		dualStackHost("192.0.2.1", true, "\x03\x03"),
+		dualStackHost("192.0.2.2", true, "\x03\x03"),
+		dualStackHost("192.0.2.3", true, "\x03\x03"),
+	})
+	if report.Verdict != verdictConsistent || report.Score != 0 {
+		t.Fatal("unexpected report:", report)
+	}
+
+	other := dualStackHost("192.0.2.3", true, "\x03\x03", "\x03\x01")
+	other.fingerprints = [][]byte{[]byte("other")}
+
+	record := TxtRecord{consistency: compareAddresses("mx.example.com", []*MxHostSummary{
+		dualStackHost("192.0.2.1", true, "\x03\x03"),
+		dualStackHost("192.0.2.2", true, "\x03\x03"),
+		other,
+		dualStackHost("192.0.2.4", true, "\x03\x03"),
+	})}
+	if record.ConsistencyVerdict() != verdictInconsistent || record.consistency.Score != 2 {
+		t.Fatal("unexpected report:", record.consistency)
+	}
+	if result := strings.Join(record.Inconsistencies(), " "); result != "certificate=192.0.2.3 tls-versions=192.0.2.3" {
+		t.Fatal("unexpected inconsistencies:", result)
+	}
+
+	// A single timeout is not an inconsistency
+	class := errorConnectTimeout
+	report = compareAddresses("mx.example.com", []*MxHostSummary{
+		dualStackHost("192.0.2.1", true, "\x03\x03"),
+		dualStackHost("192.0.2.2", true, "\x03\x03"),
+		&MxHostSummary{address: net.ParseIP("192.0.2.3"), ErrorClass: &class},
+	})
+	if report.Verdict != verdictConsistent || len(report.Addresses) != 3 {
+		t.Fatal("unexpected report:", report)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+/*
+   Verification of Signed Certificate Timestamps (RFC 6962)
+
+   The log list is expected in the format of
+   https://www.gstatic.com/ct/log_list/log_list.json
+*/
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/zmap/zgrab/ztools/x509"
+	"io/ioutil"
+	"log"
+	"math/big"
+)
+
+const (
+	ctEntryTypeX509    uint16 = 0
+	ctEntryTypePrecert uint16 = 1
+
+	ctHashSHA256  = 4
+	ctSigRSA      = 1
+	ctSigECDSA    = 3
+	ctLogIdLength = 32
+)
+
+var (
+	oidExtensionSCT = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+// A Certificate Transparency log
+type CtLog struct {
+	Description string
+	Operator    string
+	key         interface{}
+}
+
+// Known Certificate Transparency logs
+type CtLogList struct {
+	logs map[string]*CtLog // map from log id to log
+}
+
+// A Signed Certificate Timestamp
+type SignedCertificateTimestamp struct {
+	Version            uint8
+	LogId              []byte
+	Timestamp          uint64
+	Extensions         []byte
+	HashAlgorithm      uint8
+	SignatureAlgorithm uint8
+	Signature          []byte
+}
+
+// The JSON structure of the log list file
+type ctLogListFile struct {
+	Operators []struct {
+		Name string `json:"name"`
+		Id   int    `json:"id"`
+	} `json:"operators"`
+	Logs []struct {
+		Description string `json:"description"`
+		Key         []byte `json:"key"`
+		OperatedBy  []int  `json:"operated_by"`
+	} `json:"logs"`
+}
+
+// Loads the public keys of the logs from a JSON file
+func NewCtLogList(path string) (*CtLogList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file ctLogListFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	operators := make(map[int]string)
+	for _, operator := range file.Operators {
+		operators[operator.Id] = operator.Name
+	}
+
+	list := &CtLogList{logs: make(map[string]*CtLog)}
+	for _, entry := range file.Logs {
+		key, err := x509.ParsePKIXPublicKey(entry.Key)
+		if err != nil {
+			log.Println("Skipping CT log", entry.Description, err)
+			continue
+		}
+
+		ctLog := &CtLog{
+			Description: entry.Description,
+			key:         key,
+		}
+		if len(entry.OperatedBy) > 0 {
+			ctLog.Operator = operators[entry.OperatedBy[0]]
+		}
+
+		logId := sha256.Sum256(entry.Key)
+		list.logs[string(logId[:])] = ctLog
+	}
+
+	log.Println("Loaded", len(list.logs), "CT logs from", path)
+
+	return list, nil
+}
+
+// Verifies the signature of a SCT for the given log entry.
+// The entry must already be encoded as described in RFC 6962, section 3.2.
+func (list *CtLogList) Verify(sct *SignedCertificateTimestamp, entryType uint16, entry []byte) (*CtLog, error) {
+	ctLog, ok := list.logs[string(sct.LogId)]
+	if !ok {
+		return nil, errors.New("unknown log")
+	}
+
+	if sct.Version != 0 {
+		return nil, errors.New("unsupported SCT version")
+	}
+
+	if sct.HashAlgorithm != ctHashSHA256 {
+		return nil, errors.New("unsupported hash algorithm")
+	}
+
+	// Reconstruct the signed data
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte(sct.Version)
+	buffer.WriteByte(0) // signature type: certificate_timestamp
+	binary.Write(buffer, binary.BigEndian, sct.Timestamp)
+	binary.Write(buffer, binary.BigEndian, entryType)
+	buffer.Write(entry)
+	binary.Write(buffer, binary.BigEndian, uint16(len(sct.Extensions)))
+	buffer.Write(sct.Extensions)
+
+	digest := sha256.Sum256(buffer.Bytes())
+
+	switch key := ctLog.key.(type) {
+	case *ecdsa.PublicKey:
+		if sct.SignatureAlgorithm != ctSigECDSA {
+			return nil, errors.New("signature algorithm mismatch")
+		}
+		var sig struct {
+			R, S *big.Int
+		}
+		if _, err := asn1.Unmarshal(sct.Signature, &sig); err != nil {
+			return nil, err
+		}
+		if !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+			return nil, errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if sct.SignatureAlgorithm != ctSigRSA {
+			return nil, errors.New("signature algorithm mismatch")
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sct.Signature); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	return ctLog, nil
+}
+
+// Encodes a certificate as X509 log entry
+func ctX509Entry(cert *x509.Certificate) []byte {
+	return appendUint24Prefixed(nil, cert.Raw)
+}
+
+// Encodes a certificate as precertificate log entry
+func ctPrecertEntry(cert *x509.Certificate, issuer *x509.Certificate) ([]byte, error) {
+	tbs, err := removeExtension(cert.RawTBSCertificate, oidExtensionSCT)
+	if err != nil {
+		return nil, err
+	}
+	keyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	return appendUint24Prefixed(keyHash[:], tbs), nil
+}
+
+// Returns the raw SCTs embedded in a certificate
+func embeddedSCTs(cert *x509.Certificate) ([][]byte, error) {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtensionSCT) {
+			var list []byte
+			if _, err := asn1.Unmarshal(ext.Value, &list); err != nil {
+				return nil, err
+			}
+			return parseSCTList(list)
+		}
+	}
+	return nil, nil
+}
+
+// Splits a SignedCertificateTimestampList into the serialized SCTs
+func parseSCTList(data []byte) ([][]byte, error) {
+	list, rest, err := readUint16Prefixed(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after SCT list")
+	}
+
+	result := make([][]byte, 0)
+	for len(list) > 0 {
+		var sct []byte
+		if sct, list, err = readUint16Prefixed(list); err != nil {
+			return nil, err
+		}
+		result = append(result, sct)
+	}
+
+	return result, nil
+}
+
+// Parses a serialized SCT
+func ParseSCT(data []byte) (*SignedCertificateTimestamp, error) {
+	var err error
+
+	if len(data) < 1+ctLogIdLength+8 {
+		return nil, errors.New("SCT too short")
+	}
+
+	sct := &SignedCertificateTimestamp{
+		Version:   data[0],
+		LogId:     data[1 : 1+ctLogIdLength],
+		Timestamp: binary.BigEndian.Uint64(data[1+ctLogIdLength:]),
+	}
+	data = data[1+ctLogIdLength+8:]
+
+	if sct.Extensions, data, err = readUint16Prefixed(data); err != nil {
+		return nil, err
+	}
+
+	if len(data) < 2 {
+		return nil, errors.New("SCT too short")
+	}
+	sct.HashAlgorithm = data[0]
+	sct.SignatureAlgorithm = data[1]
+
+	if sct.Signature, data, err = readUint16Prefixed(data[2:]); err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		return nil, errors.New("trailing data after SCT")
+	}
+
+	return sct, nil
+}
+
+// Removes an extension from a DER encoded TBSCertificate
+func removeExtension(tbs []byte, oid asn1.ObjectIdentifier) ([]byte, error) {
+	var certificate asn1.RawValue
+	if rest, err := asn1.Unmarshal(tbs, &certificate); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after TBSCertificate")
+	}
+
+	buffer := new(bytes.Buffer)
+	fields := certificate.Bytes
+
+	for len(fields) > 0 {
+		var field asn1.RawValue
+		var err error
+		if fields, err = asn1.Unmarshal(fields, &field); err != nil {
+			return nil, err
+		}
+
+		// Only the extensions are tagged with [3]
+		if field.Class != asn1.ClassContextSpecific || field.Tag != 3 {
+			buffer.Write(field.FullBytes)
+			continue
+		}
+
+		var extensions asn1.RawValue
+		if _, err = asn1.Unmarshal(field.Bytes, &extensions); err != nil {
+			return nil, err
+		}
+
+		filtered := new(bytes.Buffer)
+		remaining := extensions.Bytes
+		for len(remaining) > 0 {
+			var raw asn1.RawValue
+			if remaining, err = asn1.Unmarshal(remaining, &raw); err != nil {
+				return nil, err
+			}
+			var ext struct {
+				Id       asn1.ObjectIdentifier
+				Critical bool `asn1:"optional"`
+				Value    []byte
+			}
+			if _, err = asn1.Unmarshal(raw.FullBytes, &ext); err != nil {
+				return nil, err
+			}
+			if !ext.Id.Equal(oid) {
+				filtered.Write(raw.FullBytes)
+			}
+		}
+
+		extensionsBytes, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: filtered.Bytes()})
+		if err != nil {
+			return nil, err
+		}
+		fieldBytes, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: extensionsBytes})
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(fieldBytes)
+	}
+
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: buffer.Bytes()})
+}
+
+// Reads a vector with a two bytes length prefix
+func readUint16Prefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("missing length prefix")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return nil, nil, errors.New("truncated vector")
+	}
+	return data[2 : 2+length], data[2+length:], nil
+}
+
+// Appends a vector with a three bytes length prefix
+func appendUint24Prefixed(dst []byte, data []byte) []byte {
+	length := len(data)
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length))
+	return append(dst, data...)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"testing"
+)
+
+func TestParseSCTList(t *testing.T) {
+	// Two SCTs with a length of 1 and 2 bytes
+	list := []byte{0, 7, 0, 1, 0xaa, 0, 2, 0xbb, 0xcc}
+	scts, err := parseSCTList(list)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scts) != 2 || len(scts[0]) != 1 || len(scts[1]) != 2 {
+		t.Fatal("unexpected value:", scts)
+	}
+
+	if _, err = parseSCTList(list[:5]); err == nil {
+		t.Fatal("truncated list accepted")
+	}
+}
+
+func TestVerifySCT(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	logId := sha256.Sum256([]byte("log"))
+	ctLog := &CtLog{Operator: "Example", key: &key.PublicKey}
+	list := &CtLogList{logs: map[string]*CtLog{string(logId[:]): ctLog}}
+
+	entry := appendUint24Prefixed(nil, []byte("certificate"))
+	sct := &SignedCertificateTimestamp{
+		LogId:              logId[:],
+		Timestamp:          1436140800000,
+		HashAlgorithm:      ctHashSHA256,
+		SignatureAlgorithm: ctSigECDSA,
+	}
+
+	// Sign the entry
+	signed := []byte{0, 0}
+	signed = append(signed, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(signed[2:], sct.Timestamp)
+	signed = append(signed, 0, 0)
+	signed = append(signed, entry...)
+	signed = append(signed, 0, 0)
+	digest := sha256.Sum256(signed)
+	r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+	sct.Signature, _ = asn1.Marshal(struct{ R, S *big.Int }{r, s})
+
+	if result, err := list.Verify(sct, ctEntryTypeX509, entry); err != nil || result != ctLog {
+		t.Fatal("valid SCT rejected:", err)
+	}
+
+	if _, err := list.Verify(sct, ctEntryTypePrecert, entry); err == nil {
+		t.Fatal("SCT with wrong entry type accepted")
+	}
+
+	sct.LogId = make([]byte, ctLogIdLength)
+	if _, err := list.Verify(sct, ctEntryTypeX509, entry); err == nil {
+		t.Fatal("SCT of unknown log accepted")
+	}
+}
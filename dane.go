@@ -0,0 +1,177 @@
+package main
+
+/*
+   DANE TLSA validation for SMTP (RFC 7672)
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"github.com/zmap/zgrab/ztools/x509"
+	"strconv"
+	"strings"
+)
+
+const (
+	DaneValid    = "valid"
+	DaneInvalid  = "invalid"
+	DaneAbsent   = "absent"
+	DaneInsecure = "insecure"
+	DaneUnknown  = "unknown" // the TLSA lookup has failed
+
+	tlsaUsageDaneTA = 2
+	tlsaUsageDaneEE = 3
+)
+
+type TlsaRecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// Name of the TLSA record for a MX hostname
+func tlsaName(hostname string) string {
+	return "_25._tcp." + hostname
+}
+
+// Parses the string representation created by DnsResult.appendRR
+func parseTlsaRecord(str string) (*TlsaRecord, error) {
+	fields := strings.Fields(str)
+	if len(fields) != 4 {
+		return nil, errors.New("invalid TLSA record: " + str)
+	}
+
+	values := make([]uint8, 3)
+	for i := range values {
+		value, err := strconv.ParseUint(fields[i], 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = uint8(value)
+	}
+
+	data, err := hex.DecodeString(fields[3])
+	if err != nil {
+		return nil, err
+	}
+
+	return &TlsaRecord{
+		Usage:        values[0],
+		Selector:     values[1],
+		MatchingType: values[2],
+		Data:         data,
+	}, nil
+}
+
+// Checks if the certificate matches the selector and the association data
+func (record *TlsaRecord) Matches(cert *x509.Certificate) bool {
+	var data []byte
+
+	switch record.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch record.MatchingType {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+
+	return bytes.Equal(data, record.Data)
+}
+
+// Checks if the presented chain is authenticated by one of the TLSA records.
+// The PKIX usages are not applicable to SMTP and never match.
+func daneAuthenticated(records []*TlsaRecord, hostname string, certs []*x509.Certificate) bool {
+	if len(certs) == 0 {
+		return false
+	}
+	leaf := certs[0]
+
+	for _, record := range records {
+		switch record.Usage {
+		case tlsaUsageDaneEE:
+			// Neither the name nor the expiration is checked
+			if record.Matches(leaf) {
+				return true
+			}
+		case tlsaUsageDaneTA:
+			if leaf.VerifyHostname(hostname) != nil {
+				continue
+			}
+			for i := 1; i < len(certs); i++ {
+				if record.Matches(certs[i]) && chainSigned(certs[:i+1]) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Checks if every certificate is signed by its successor
+func chainSigned(chain []*x509.Certificate) bool {
+	for i := 0; i < len(chain)-1; i++ {
+		if chain[i].CheckSignatureFrom(chain[i+1]) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Determines the DANE status of a MX hostname
+func daneStatus(tlsa *DnsResult, hostname string, hosts []*MxHostSummary) string {
+	// A failed lookup must not be treated as absent (RFC 7672 section 2.2)
+	if tlsa != nil && tlsa.Error != nil {
+		return DaneUnknown
+	}
+
+	if tlsa == nil || len(tlsa.Results) == 0 {
+		return DaneAbsent
+	}
+
+	if !tlsa.Secure {
+		return DaneInsecure
+	}
+
+	records := make([]*TlsaRecord, 0, len(tlsa.Results))
+	for _, str := range tlsa.Results {
+		if record, err := parseTlsaRecord(str); err == nil {
+			records = append(records, record)
+		}
+	}
+
+	// Every reachable host must present an authenticated chain
+	reachable := false
+	for _, host := range hosts {
+		if host == nil || host.Starttls == nil {
+			continue
+		}
+		reachable = true
+		if !daneAuthenticated(records, hostname, host.certificates) {
+			return DaneInvalid
+		}
+	}
+
+	if !reachable {
+		return DaneInvalid
+	}
+
+	return DaneValid
+}
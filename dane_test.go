@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/zmap/zgrab/ztools/x509"
+	"testing"
+)
+
+func TestParseTlsaRecord(t *testing.T) {
+	record, err := parseTlsaRecord("3 1 1 0a0b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Usage != 3 || record.Selector != 1 || record.MatchingType != 1 || hex.EncodeToString(record.Data) != "0a0b" {
+		t.Fatal("unexpected value:", record)
+	}
+
+	if _, err = parseTlsaRecord("3 1 1"); err == nil {
+		t.Fatal("invalid record accepted")
+	}
+}
+
+func TestDaneStatus(t *testing.T) {
+	cert := parseCertificate("testdata/example.com.crt")
+	hosts := []*MxHostSummary{&MxHostSummary{Starttls: &True, certificates: []*x509.Certificate{cert}}}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	matching := "3 1 1 " + hex.EncodeToString(sum[:])
+
+	check := func(expected string, tlsa *DnsResult) {
+		if status := daneStatus(tlsa, "example.com", hosts); status != expected {
+			t.Fatal("unexpected status:", status, "expected:", expected)
+		}
+	}
+
+	check(DaneAbsent, &DnsResult{})
+	check(DaneUnknown, &DnsResult{Error: errors.New("SERVFAIL")})
+	check(DaneInsecure, &DnsResult{Results: []string{matching}})
+	check(DaneValid, &DnsResult{Results: []string{matching}, Secure: true})
+	check(DaneInvalid, &DnsResult{Results: []string{"3 1 1 0a0b"}, Secure: true})
+
+	// PKIX usages are not applicable to SMTP
+	check(DaneInvalid, &DnsResult{Results: []string{"1 1 1 " + hex.EncodeToString(sum[:])}, Secure: true})
+}
@@ -8,7 +8,9 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/zmap/zgrab/ztools/x509"
 	"log"
+	"net"
 	"strings"
+	"time"
 )
 
 var (
@@ -35,26 +37,35 @@ func connect(dataSourceName string) {
 }
 
 // Reads mx_hosts from the domains table and passes them to the MxProcessor
+// together with the recipient domains pointing to them
 func resolveDomainMxHosts() {
 	log.Println("load mx_hosts from domains")
-	rows, err := dbconn.Query("SELECT DISTINCT unnest(mx_hosts) FROM domains")
+	rows, err := dbconn.Query("SELECT mx, name FROM (SELECT unnest(mx_hosts) AS mx, name FROM domains) AS t ORDER BY mx")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer rows.Close()
 
+	var previous string
 	for rows.Next() {
-		var hostname string
-		if err := rows.Scan(&hostname); err != nil {
+		var hostname, domain string
+		if err := rows.Scan(&hostname, &domain); err != nil {
 			log.Fatal(err)
 		}
-		mxProcessor.NewJob(hostname)
+		if hostname != previous && previous != "" {
+			mxProcessor.NewJob(previous)
+		}
+		mxProcessor.AddDomain(hostname, domain)
+		previous = hostname
 	}
 
 	if err := rows.Err(); err != nil {
 		log.Fatal(err)
 	}
 
+	if previous != "" {
+		mxProcessor.NewJob(previous)
+	}
 }
 
 func updateCertificates() {
@@ -93,6 +104,152 @@ func updateCertificates() {
 	}
 }
 
+// Rebuilds the chains of all mx_hosts from the stored certificates
+// and updates the validity at the given reference time.
+func revalidateMxHosts(at time.Time) {
+	batchSize := 10000
+	i := 0
+	id := 0
+
+	log.Println("revalidate mx_hosts at", at)
+
+	// MX hostnames whose TXT records depend on a changed validity
+	hostnames := make(map[string]bool)
+
+	for {
+		hosts := loadMxHostCertificates(id, batchSize)
+		if len(hosts) == 0 {
+			break
+		}
+
+		for _, host := range hosts {
+			id = host.id
+			if len(host.certs) == 0 {
+				continue
+			}
+
+			validity := NewCertificateValidityAt(host.certs, nil, at)
+			updateMxHostValidity(host.id, validity)
+
+			columns := newValidityColumns(validity)
+			changed := !equalBool(host.certTrusted, columns.certTrusted) || !equalBool(host.certExpired, columns.certExpired)
+			if changed && host.target.Port == portSMTP && host.target.ServerName != "" {
+				hostnames[host.target.ServerName] = true
+				if hostProcessor != nil {
+					hostProcessor.setValidity(host.target, validity)
+				}
+			}
+
+			i += 1
+			if i%1000 == 0 {
+				log.Println(i, "mx_hosts revalidated")
+			}
+		}
+	}
+
+	// Run the policy again, the cached host checks have the new validity
+	if mxProcessor != nil {
+		for hostname := range hostnames {
+			mxProcessor.Refresh(hostname)
+		}
+	}
+	log.Println(i, "mx_hosts revalidated,", len(hostnames), "MX hostnames refreshed")
+}
+
+// Compares two nullable booleans
+func equalBool(a, b *bool) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+// The stored certificates of a mx_host, the server certificate comes first
+type mxHostCertificates struct {
+	id          int
+	target      *ScanTarget
+	certTrusted *bool // the stored validity
+	certExpired *bool
+	certs       []*x509.Certificate // nil if the chain can not be loaded
+}
+
+// Loads the certificates of the next mx_hosts after the given id in a single query.
+// The intermediates keep the order of ca_certificate_ids.
+func loadMxHostCertificates(afterId int, limit int) []*mxHostCertificates {
+	rows, err := dbconn.Query("WITH hosts AS (SELECT id, address, port, server_name, cert_trusted, cert_expired, certificate_id, ca_certificate_ids FROM mx_hosts WHERE id > $1 AND certificate_id IS NOT NULL ORDER BY id LIMIT $2) SELECT h.id, h.address, h.port, h.server_name, h.cert_trusted, h.cert_expired, r.id = h.certificate_id, r.raw FROM hosts h LEFT JOIN raw_certificates r ON r.id = h.certificate_id OR r.id = ANY(h.ca_certificate_ids) ORDER BY h.id, r.id = h.certificate_id DESC, array_position(h.ca_certificate_ids, r.id)", afterId, limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	result := make([]*mxHostCertificates, 0, limit)
+	var host *mxHostCertificates
+	var failed bool
+
+	for rows.Next() {
+		var id int
+		var address string
+		var port uint16
+		var serverName string
+		var certTrusted, certExpired *bool
+		var isLeaf *bool
+		var raw []byte
+		if err := rows.Scan(&id, &address, &port, &serverName, &certTrusted, &certExpired, &isLeaf, &raw); err != nil {
+			log.Fatal(err)
+		}
+
+		if host == nil || host.id != id {
+			host = &mxHostCertificates{
+				id:          id,
+				target:      &ScanTarget{Address: net.ParseIP(address), Port: port, ServerName: serverName},
+				certTrusted: certTrusted,
+				certExpired: certExpired,
+			}
+			result = append(result, host)
+			failed = false
+
+			// The server certificate must come first
+			if isLeaf == nil || !*isLeaf {
+				log.Println("server certificate of mx_host", id, "not found")
+				failed = true
+				continue
+			}
+		}
+		if failed {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			log.Println("unable to parse certificate of mx_host", id, err)
+			host.certs = nil
+			failed = true
+			continue
+		}
+		host.certs = append(host.certs, cert)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	return result
+}
+
+// Updates the validity columns of a mx_host
+func updateMxHostValidity(id int, validity *CertificateValidity) {
+	columns := newValidityColumns(validity)
+	_, err := dbconn.Exec("UPDATE mx_hosts SET chain_root_id=$1, chain_intermediate_ids=$2, cert_expired=$3, cert_trusted=$4, cert_error=$5, chain_incomplete=$6 WHERE id=$7",
+		columns.rootFingerprint,
+		ByteaArray(columns.intermediateFingerprints),
+		columns.certExpired,
+		columns.certTrusted,
+		columns.certError,
+		columns.chainIncomplete,
+		id,
+	)
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
 func saveDomain(job *DnsJob) {
 	result := job.Result
 	domain := job.Query.Domain
@@ -165,6 +322,7 @@ func saveCertificateWithUpdate(cert *x509.Certificate, exists bool) {
 
 	var pubkeySize *int
 	var pubkeyBlacklisted *bool
+	var pubkeyWeaknesses []string
 	switch key := cert.PublicKey.(type) {
 	case *rsa.PublicKey:
 		// Key length
@@ -172,17 +330,21 @@ func saveCertificateWithUpdate(cert *x509.Certificate, exists bool) {
 		pubkeySize = &len
 
 		if opensslBlacklist != nil {
-			v := opensslBlacklist.Contains(cert)
-			pubkeyBlacklisted = &v
+			pubkeyBlacklisted = opensslBlacklist.Contains(cert)
 		}
 	}
 
+	if keyChecker != nil {
+		pubkeyWeaknesses = keyChecker.Check(cert)
+	}
+
 	params := []interface{}{
 		subject,
 		issuer,
 		pubkey,
 		pubkeySize,
 		pubkeyBlacklisted,
+		StringArray(pubkeyWeaknesses),
 		signatureAlgorithm,
 		publicKeyAlgorithm,
 		selfSigned,
@@ -194,82 +356,214 @@ func saveCertificateWithUpdate(cert *x509.Certificate, exists bool) {
 
 	var err error
 	if exists {
-		_, err = dbconn.Exec("UPDATE certificates SET subject_id=$1, issuer_id=$2, key_id=$3, key_size=$4, key_blacklisted=$5, signature_algorithm=$6, key_algorithm=$7, is_self_signed=$8, is_ca=$9, days_valid=ROUND($10), not_after=$11 WHERE id=$12", params...)
+		_, err = dbconn.Exec("UPDATE certificates SET subject_id=$1, issuer_id=$2, key_id=$3, key_size=$4, key_blacklisted=$5, key_weaknesses=$6, signature_algorithm=$7, key_algorithm=$8, is_self_signed=$9, is_ca=$10, days_valid=ROUND($11), not_after=$12 WHERE id=$13", params...)
 	} else {
-		_, err = dbconn.Exec("INSERT INTO certificates (subject_id, issuer_id, key_id, key_size, key_blacklisted, signature_algorithm, key_algorithm, is_self_signed, is_ca, days_valid, not_after, first_seen_at, id) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9, ROUND($10), $11, NOW(), $12)", params...)
+		_, err = dbconn.Exec("INSERT INTO certificates (subject_id, issuer_id, key_id, key_size, key_blacklisted, key_weaknesses, signature_algorithm, key_algorithm, is_self_signed, is_ca, days_valid, not_after, first_seen_at, id) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10, ROUND($11), $12, NOW(), $13)", params...)
 	}
 	if err != nil {
 		log.Panicln(err, hex.EncodeToString(cert.FingerprintSHA1))
 	}
 }
 
+// Is the key of the certificate saved with another subject?
+func keyHasOtherSubject(cert *x509.Certificate) bool {
+	pubkey := string(x509.SHA1Fingerprint(cert.RawSubjectPublicKeyInfo))
+	subject := string(x509.SHA1Fingerprint(cert.RawSubject))
+
+	var exists bool
+	err := dbconn.QueryRow("SELECT TRUE FROM certificates WHERE key_id = $1 AND subject_id <> $2 LIMIT 1", pubkey, subject).Scan(&exists)
+	switch err {
+	case sql.ErrNoRows:
+		return false
+	case nil:
+		return true
+	default:
+		log.Fatal(err)
+	}
+	return false
+}
+
+// The columns of mx_hosts that depend on the certificate validity
+type validityColumns struct {
+	rootFingerprint          *[]byte
+	intermediateFingerprints [][]byte
+	certTrusted              *bool
+	certExpired              *bool
+	certError                *string
+	chainIncomplete          *bool
+}
+
+func newValidityColumns(v *CertificateValidity) (columns validityColumns) {
+	if v == nil {
+		return
+	}
+
+	var trusted bool
+	if root := v.RootCertificate(); root != nil {
+		trusted = true
+		fingerprint := []byte(root.FingerprintSHA1)
+		columns.rootFingerprint = &fingerprint
+	} else {
+		trusted = false
+	}
+	// Copy fingerprints of intermediate certificates
+	if intermediates := v.IntermediateCertificates(); intermediates != nil {
+		columns.intermediateFingerprints = make([][]byte, len(intermediates))
+		for i, cert := range intermediates {
+			columns.intermediateFingerprints[i] = []byte(cert.FingerprintSHA1)
+		}
+	}
+
+	columns.certTrusted = &trusted
+
+	// expiriation status of the server certificate
+	columns.certExpired = &v.Expired
+
+	// Copy validation error
+	columns.certError = v.ErrorString()
+
+	// Has the server left out intermediates?
+	columns.chainIncomplete = &v.Incomplete
+
+	return
+}
+
 // Saves a MxHost in the database
 func saveMxHostSummary(result *MxHostSummary) {
 	address := result.address.String()
 
 	var id int
-	err := dbconn.QueryRow("SELECT id FROM mx_hosts WHERE address = $1", address).Scan(&id)
+	err := dbconn.QueryRow("SELECT id FROM mx_hosts WHERE address = $1 AND port = $2 AND server_name = $3", address, result.port, result.serverName).Scan(&id)
 
-	var rootFingerprint *[]byte
-	var intermediateFingerprints [][]byte
-	var certTrusted *bool
-	var certExpired *bool
-	var certError *string
+	var sctCount *int
+	var sctOperators *int
 
 	// certificate validity
-	if v := result.validity; v != nil {
-		var trusted bool
-		if root := v.RootCertificate(); root != nil {
-			trusted = true
-			fingerprint := []byte(root.FingerprintSHA1)
-			rootFingerprint = &fingerprint
-		} else {
-			trusted = false
-		}
-		// Copy fingerprints of intermediate certificates
-		if intermediates := v.IntermediateCertificates(); intermediates != nil {
-			intermediateFingerprints = make([][]byte, len(intermediates))
-			for i, cert := range intermediates {
-				intermediateFingerprints[i] = []byte(cert.FingerprintSHA1)
-			}
-		}
+	columns := newValidityColumns(result.validity)
 
-		certTrusted = &trusted
-
-		// expiriation status of the server certificate
-		certExpired = &v.Expired
+	// Certificate Transparency
+	if v := result.validity; v != nil && ctLogs != nil {
+		sctCount = &v.SCTs
+		sctOperators = &v.SCTOperators
+	}
 
-		// Copy validation error
-		certError = v.ErrorString()
+	// Local address for abuse handling
+	var sourceAddress *string
+	if result.sourceAddress != nil {
+		str := result.sourceAddress.String()
+		sourceAddress = &str
 	}
 
+	// The columns that only depend on the grabs come first
 	params := []interface{}{
 		result.Error,
+		result.ErrorClass,
 		result.Starttls,
 		ByteaArray(setToByteArrays(result.tlsVersions)),
 		ByteaArray(setToByteArrays(result.tlsCipherSuites)),
 		result.ServerFingerprint(),
 		ByteaArray(result.CaFingerprints()),
-		rootFingerprint,
-		ByteaArray(intermediateFingerprints),
-		certExpired,
-		certTrusted,
-		certError,
+		columns.rootFingerprint,
+		ByteaArray(columns.intermediateFingerprints),
+		columns.certExpired,
+		columns.certTrusted,
+		columns.certError,
+		columns.chainIncomplete,
 		result.ecdheCurveType,
 		result.ecdheCurveId,
+		result.ecdheKeyLength,
+		result.dhPrimeBits,
+		result.dhPrimeCommon,
+		result.forwardSecrecy,
+		sctCount,
+		sctOperators,
+		result.banner,
+		result.mtaProduct,
+		result.mtaVersion,
+		result.transcript,
 		result.Updated,
 		address,
+		result.port,
+		result.serverName,
+	}
+	derivedParams := len(params)
+
+	// Results of the other connections and lookups of a host check
+	params = append(params,
+		StringArray(result.ptrNames),
+		StringArray(result.CipherOrderStrings()),
+		ByteaArray(result.AcceptedCipherSuites()),
+		result.sniCertDiffers,
+		StringArray(result.ehloExtensions),
+		StringArray(result.authMechanisms),
+		sourceAddress,
+	)
+
+	switch {
+	case err == sql.ErrNoRows:
+		// not yet present
+		_, err := dbconn.Exec("INSERT INTO mx_hosts (error, error_class, starttls, tls_versions, tls_cipher_suites, certificate_id, ca_certificate_ids, chain_root_id, chain_intermediate_ids, cert_expired, cert_trusted, cert_error, chain_incomplete, ecdhe_curve_type, ecdhe_curve_id, ecdhe_key_length, dh_prime_bits, dh_prime_common, forward_secrecy, sct_count, sct_operators, banner, mta_product, mta_version, transcript, updated_at, ptr_names, tls_cipher_order, tls_accepted_cipher_suites, sni_cert_differs, ehlo_extensions, auth_mechanisms, source_address, address, port, server_name) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25,$26,$30,$31,$32,$33,$34,$35,$36,$27,$28,$29)", params...)
+		if err != nil {
+			log.Panicln(err)
+		}
+	case err == nil && result.partial:
+		// Keep the results that can not be derived from the grabs
+		_, err := dbconn.Exec("UPDATE mx_hosts SET error=$1, error_class=$2, starttls=$3, tls_versions=$4, tls_cipher_suites=$5, certificate_id=$6, ca_certificate_ids=$7, chain_root_id=$8, chain_intermediate_ids=$9, cert_expired=$10, cert_trusted=$11, cert_error=$12, chain_incomplete=$13, ecdhe_curve_type=$14, ecdhe_curve_id=$15, ecdhe_key_length=$16, dh_prime_bits=$17, dh_prime_common=$18, forward_secrecy=$19, sct_count=$20, sct_operators=$21, banner=$22, mta_product=$23, mta_version=$24, transcript=$25, updated_at=$26 WHERE address = $27 AND port = $28 AND server_name = $29", params[:derivedParams]...)
+		if err != nil {
+			log.Panicln(err)
+		}
+	case err == nil:
+		_, err := dbconn.Exec("UPDATE mx_hosts SET error=$1, error_class=$2, starttls=$3, tls_versions=$4, tls_cipher_suites=$5, certificate_id=$6, ca_certificate_ids=$7, chain_root_id=$8, chain_intermediate_ids=$9, cert_expired=$10, cert_trusted=$11, cert_error=$12, chain_incomplete=$13, ecdhe_curve_type=$14, ecdhe_curve_id=$15, ecdhe_key_length=$16, dh_prime_bits=$17, dh_prime_common=$18, forward_secrecy=$19, sct_count=$20, sct_operators=$21, banner=$22, mta_product=$23, mta_version=$24, transcript=$25, updated_at=$26, ptr_names=$30, tls_cipher_order=$31, tls_accepted_cipher_suites=$32, sni_cert_differs=$33, ehlo_extensions=$34, auth_mechanisms=$35, source_address=$36 WHERE address = $27 AND port = $28 AND server_name = $29", params...)
+		if err != nil {
+			log.Panicln(err)
+		}
+	default:
+		log.Fatal(err)
 	}
 
-	switch err {
-	case sql.ErrNoRows:
+	if result.vulnerabilities != nil {
+		saveMxHostVulnerabilities(result)
+	}
+}
+
+// Saves the results of the vulnerability probes
+func saveMxHostVulnerabilities(result *MxHostSummary) {
+	address := result.address.String()
+	vulns := result.vulnerabilities
+
+	var id int
+	err := dbconn.QueryRow("SELECT id FROM mx_host_vulnerabilities WHERE address = $1 AND port = $2 AND server_name = $3", address, result.port, result.serverName).Scan(&id)
+
+	// The passive results come first
+	params := []interface{}{
+		vulns.Compression,
+		vulns.InsecureRenegotiation,
+		vulns.Heartbeat,
+		vulns.ClientCertRequested,
+		result.Updated,
+		address,
+		result.port,
+		result.serverName,
+		vulns.RC4,
+		vulns.Export,
+		vulns.FallbackSCSV,
+	}
+
+	switch {
+	case err == sql.ErrNoRows:
 		// not yet present
-		_, err := dbconn.Exec("INSERT INTO mx_hosts (error, starttls, tls_versions, tls_cipher_suites, certificate_id, ca_certificate_ids, chain_root_id, chain_intermediate_ids, cert_expired, cert_trusted, cert_error, ecdhe_curve_type, ecdhe_curve_id, updated_at, address) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)", params...)
+		_, err := dbconn.Exec("INSERT INTO mx_host_vulnerabilities (compression, insecure_renegotiation, heartbeat, client_cert_requested, updated_at, address, port, server_name, rc4, export, fallback_scsv) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)", params...)
 		if err != nil {
 			log.Panicln(err)
 		}
-	case nil:
-		_, err := dbconn.Exec("UPDATE mx_hosts SET error=$1, starttls=$2, tls_versions=$3, tls_cipher_suites=$4, certificate_id=$5, ca_certificate_ids=$6, chain_root_id=$7, chain_intermediate_ids=$8, cert_expired=$9, cert_trusted=$10, cert_error=$11, ecdhe_curve_type=$12, ecdhe_curve_id=$13, updated_at=$14 WHERE address = $15", params...)
+	case err == nil && result.partial:
+		// Keep the results of the active probes
+		_, err := dbconn.Exec("UPDATE mx_host_vulnerabilities SET compression=$1, insecure_renegotiation=$2, heartbeat=$3, client_cert_requested=$4, updated_at=$5 WHERE address = $6 AND port = $7 AND server_name = $8", params[:8]...)
+		if err != nil {
+			log.Panicln(err)
+		}
+	case err == nil:
+		_, err := dbconn.Exec("UPDATE mx_host_vulnerabilities SET compression=$1, insecure_renegotiation=$2, heartbeat=$3, client_cert_requested=$4, updated_at=$5, rc4=$9, export=$10, fallback_scsv=$11 WHERE address = $6 AND port = $7 AND server_name = $8", params...)
 		if err != nil {
 			log.Panicln(err)
 		}
@@ -291,18 +585,25 @@ func saveMxRecord(result *MxRecord) {
 		result.String(), // TXT record
 		result.starttls,
 		StringArray(setToStringArrays(result.certProblems)),
+		StringArray(setToStringArrays(result.problems)),
+		result.dane,
+		StringArray(setToStringArrays(result.certNames)),
+		StringArray(setToStringArrays(result.matchedNames)),
+		StringArray(result.DualStackDifferences()),
+		result.ConsistencyVerdict(),
+		StringArray(result.Inconsistencies()),
 		result.domain,
 	}
 
 	switch err {
 	case sql.ErrNoRows:
 		// not yet present
-		_, err := dbconn.Exec("INSERT INTO mx_records (addresses, dns_secure, dns_error, dns_bogus, txt, starttls, cert_problems, updated_at, hostname) VALUES ($1,$2,$3,$4,$5,$6,$7,NOW(),$8)", params...)
+		_, err := dbconn.Exec("INSERT INTO mx_records (addresses, dns_secure, dns_error, dns_bogus, txt, starttls, cert_problems, problems, dane, cert_names, cert_matched_names, dual_stack, consistency, inconsistencies, updated_at, hostname) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,NOW(),$15)", params...)
 		if err != nil {
 			log.Panicln(err)
 		}
 	case nil:
-		_, err := dbconn.Exec("UPDATE mx_records SET addresses=$1, dns_secure=$2, dns_error=$3, dns_bogus=$4, txt=$5, starttls=$6, cert_problems=$7, updated_at=NOW() WHERE hostname=$8", params...)
+		_, err := dbconn.Exec("UPDATE mx_records SET addresses=$1, dns_secure=$2, dns_error=$3, dns_bogus=$4, txt=$5, starttls=$6, cert_problems=$7, problems=$8, dane=$9, cert_names=$10, cert_matched_names=$11, dual_stack=$12, consistency=$13, inconsistencies=$14, updated_at=NOW() WHERE hostname=$15", params...)
 		if err != nil {
 			log.Panicln(err)
 		}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+)
+
+const minDhPrimeBits = 2048 // recommended by weakdh.org
+
+// Common primes used by many servers. A precomputation for one of them
+// breaks all connections using it (Logjam).
+var commonDhPrimes = map[string]*big.Int{
+	"rfc2409-768":  dhPrime(rfc2409Prefix + "A63A3620FFFFFFFFFFFFFFFF"),
+	"rfc2409-1024": dhPrime(rfc2409Prefix + oakley1024Suffix),
+	"rfc3526-1536": dhPrime(rfc3526Prefix + "CA237327FFFFFFFFFFFFFFFF"),
+	"rfc3526-2048": dhPrime(rfc3526Prefix + "CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF"),
+}
+
+const (
+	rfc2409Prefix    = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9"
+	oakley1024Suffix = "A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF"
+	rfc3526Prefix    = rfc2409Prefix + "A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08"
+)
+
+// Named curves with less than 256 bits
+var weakCurves = map[uint16]bool{
+	1: true, 2: true, 3: true, 4: true, 5: true, 6: true, 7: true, 8: true, // sect163k1 to sect239k1
+	15: true, 16: true, 17: true, 18: true, 19: true, 20: true, 21: true, // secp160k1 to secp224r1
+}
+
+// Public key lengths of the curves supported by crypto/tls.
+// Other groups, e.g. the hybrid X25519MLKEM768, have an unknown length.
+var curveKeyLengths = map[uint16]int{
+	23: 65,  // secp256r1
+	24: 97,  // secp384r1
+	25: 133, // secp521r1
+	29: 32,  // x25519
+}
+
+func dhPrime(hex string) *big.Int {
+	prime, ok := new(big.Int).SetString(hex, 16)
+	if !ok {
+		panic("invalid prime: " + hex)
+	}
+	return prime
+}
+
+// Returns the name of a common prime or an empty string
+func commonDhPrimeName(prime *big.Int) string {
+	for name, common := range commonDhPrimes {
+		if prime.Cmp(common) == 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// Uses the cipher suite an ephemeral key exchange?
+func isForwardSecret(version uint16, suite uint16) bool {
+	if version >= versionTLS13 {
+		return true
+	}
+	name := cipherSuiteNames[suite]
+	return strings.Contains(name, "_DHE_") || strings.Contains(name, "_ECDHE_")
+}
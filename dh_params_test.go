@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/zmap/zgrab/ztools/ztls"
+	"math/big"
+	"testing"
+)
+
+func TestCommonDhPrimes(t *testing.T) {
+	for name, prime := range commonDhPrimes {
+		// All common primes are safe primes
+		q := new(big.Int).Rsh(prime, 1)
+		if !prime.ProbablyPrime(20) || !q.ProbablyPrime(20) {
+			t.Errorf("%s is not a safe prime", name)
+		}
+		if commonDhPrimeName(prime) != name {
+			t.Errorf("%s not found", name)
+		}
+	}
+}
+
+func TestAppendDhParams(t *testing.T) {
+	summary := &MxHostSummary{}
+	summary.Append(&MxHostGrab{
+		tlsVersion:     ztls.VersionTLS12,
+		tlsCipherSuite: 0xc02f, // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+		dhParams:       &ztls.ECDHEParams{CurveType: curveTypeNamedCurve, CurveID: 23, PublicKeyLength: 65},
+	})
+	if summary.HasWeakDH() || summary.forwardSecrecy == nil || !*summary.forwardSecrecy {
+		t.Fatal("expected strong forward secret key exchange")
+	}
+
+	summary.Append(&MxHostGrab{
+		tlsVersion:     ztls.VersionTLS10,
+		tlsCipherSuite: 0x0033, // TLS_DHE_RSA_WITH_AES_128_CBC_SHA
+		dhParams:       &ztls.DHParams{Prime: commonDhPrimes["rfc2409-1024"], Generator: big.NewInt(2)},
+	})
+	if !summary.HasWeakDH() {
+		t.Fatal("1024 bit prime should be weak")
+	}
+	if summary.dhPrimeCommon == nil || *summary.dhPrimeCommon != "rfc2409-1024" {
+		t.Fatal("common prime not detected")
+	}
+
+	summary.Append(&MxHostGrab{
+		tlsVersion:     ztls.VersionTLS10,
+		tlsCipherSuite: 0x002f, // TLS_RSA_WITH_AES_128_CBC_SHA
+	})
+	if *summary.forwardSecrecy {
+		t.Fatal("RSA key exchange is not forward secret")
+	}
+}
+
+func TestAppendUnknownGroup(t *testing.T) {
+	summary := &MxHostSummary{}
+	summary.Append(&MxHostGrab{
+		tlsVersion:     0x0304,                                                                                                   // TLS 1.3
+		tlsCipherSuite: 0x1301,                                                                                                   // TLS_AES_128_GCM_SHA256
+		dhParams:       &ztls.ECDHEParams{CurveType: curveTypeNamedCurve, CurveID: 4588, PublicKeyLength: curveKeyLengths[4588]}, // X25519MLKEM768
+	})
+	if summary.ecdheKeyLength != nil {
+		t.Fatal("key length should be unknown, got", *summary.ecdheKeyLength)
+	}
+	if summary.HasWeakDH() {
+		t.Fatal("unknown group should not be weak")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/miekg/dns"
 	"github.com/miekg/unbound"
 	"log"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,6 +17,7 @@ const (
 	TypeA    = dns.Type(dns.TypeA)
 	TypeAAAA = dns.Type(dns.TypeAAAA)
 	TypeTLSA = dns.Type(dns.TypeTLSA)
+	TypePTR  = dns.Type(dns.TypePTR)
 )
 
 type DnsQuery struct {
@@ -149,6 +151,12 @@ func (group *DnsJobs) Wait() {
 	}
 }
 
+// Name for the reverse lookup of an address
+func reverseName(address net.IP) string {
+	name, _ := dns.ReverseAddr(address.String())
+	return strings.TrimSuffix(name, ".")
+}
+
 // Appends a new entry to the result
 func (result *DnsResult) append(entry string) {
 	result.Results = append(result.Results, entry)
@@ -162,6 +170,8 @@ func (result *DnsResult) appendRR(rr interface{}) {
 		result.append(record.A.String())
 	case *dns.AAAA:
 		result.append(record.AAAA.String())
+	case *dns.PTR:
+		result.append(strings.ToLower(strings.TrimSuffix(record.Ptr, ".")))
 	case *dns.TLSA:
 		result.append(strconv.Itoa(int(record.Usage)) +
 			" " + strconv.Itoa(int(record.Selector)) +
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/miekg/dns"
 	"log"
+	"net"
 	"strings"
 )
 
@@ -11,7 +12,7 @@ type DnsServer struct {
 	zone   string
 }
 
-// Creates a new DNS server
+// Creates a new DNS server. The address may have port 0 to pick a free port.
 func NewDnsServer(address string, zone string) *DnsServer {
 	// Append dot to zone if missing
 	if !strings.HasSuffix(zone, ".") {
@@ -25,18 +26,23 @@ func NewDnsServer(address string, zone string) *DnsServer {
 		zone = "." + zone
 	}
 
+	// Bind before returning, so that the address is known
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		log.Fatalf("Failed to setup the server: %s\n", err.Error())
+	}
+
 	server := &DnsServer{
 		zone: zone,
 		server: dns.Server{
-			Addr: address,
-			Net:  "udp",
+			PacketConn: conn,
 		},
 	}
 	server.server.Handler = dns.HandlerFunc(server.handle)
 
 	// Serve in the background
 	go func() {
-		err := server.server.ListenAndServe()
+		err := server.server.ActivateAndServe()
 		if err != nil {
 			log.Panicf("Failed to setup the server: %s\n", err.Error())
 		}
@@ -45,6 +51,11 @@ func NewDnsServer(address string, zone string) *DnsServer {
 	return server
 }
 
+// The address the server is listening on
+func (dnsServer *DnsServer) Addr() string {
+	return dnsServer.server.PacketConn.LocalAddr().String()
+}
+
 // Shuts down the server
 func (dnsServer *DnsServer) Close() error {
 	return dnsServer.server.Shutdown()
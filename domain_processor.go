@@ -22,6 +22,13 @@ func NewDomainProcessor(workersCount uint) *DomainProcessor {
 		mxAddresses := dnsProcessor.NewJob(domain, TypeMX)
 		mxAddresses.Wait()
 
+		// Remember the recipient domain for the certificate checks
+		if mxProcessor != nil {
+			for _, hostname := range mxAddresses.Result.Results {
+				mxProcessor.AddDomain(hostname, domain)
+			}
+		}
+
 		if resultProcessor != nil {
 			resultProcessor.Add(mxAddresses)
 		}
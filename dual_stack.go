@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/deckarep/golang-set"
+	"sort"
+	"time"
+)
+
+// Differences between the IPv4 and IPv6 hosts of a MX hostname
+type DualStackReport struct {
+	Hostname    string    `json:"hostname"`
+	Differences []string  `json:"differences"`
+	Weaker      string    `json:"weaker,omitempty"` // the family with the weaker configuration
+	Updated     time.Time `json:"updated"`
+}
+
+// Summary of the hosts of one address family
+type familySummary struct {
+	reachable    bool
+	starttls     bool
+	trusted      bool
+	highest      uint16 // highest negotiated TLS version
+	fingerprints mapset.Set
+	versions     mapset.Set
+}
+
+func newFamilySummary(hosts []*MxHostSummary) *familySummary {
+	family := &familySummary{
+		starttls:     true,
+		trusted:      true,
+		fingerprints: mapset.NewThreadUnsafeSet(),
+		versions:     mapset.NewThreadUnsafeSet(),
+	}
+
+	for _, host := range hosts {
+		// Unreachable hosts are not compared
+		if host.Starttls == nil {
+			continue
+		}
+		family.reachable = true
+
+		if !*host.Starttls || len(host.certificates) == 0 {
+			family.starttls = false
+			continue
+		}
+		if fingerprint := host.ServerFingerprint(); fingerprint != nil {
+			family.fingerprints.Add(string(*fingerprint))
+		}
+		if host.validity == nil || host.validity.TrustedNames().Cardinality() == 0 {
+			family.trusted = false
+		}
+		if host.tlsVersions != nil {
+			for item := range host.tlsVersions.Iter() {
+				family.versions.Add(item)
+				version := item.(string)
+				if v := uint16(version[0])<<8 | uint16(version[1]); v > family.highest {
+					family.highest = v
+				}
+			}
+		}
+	}
+
+	if !family.reachable {
+		family.starttls = false
+	}
+	if !family.starttls {
+		family.trusted = false
+	}
+	return family
+}
+
+// Orders the families: the weaker one has the lower rank
+func (family *familySummary) rank() []int {
+	toInt := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	return []int{toInt(family.reachable), toInt(family.starttls), toInt(family.trusted), int(family.highest)}
+}
+
+// Compares the IPv4 and IPv6 hosts. Returns nil if the hostname is not dual-stack.
+// Hosts with transient errors are left out.
+func compareDualStack(hostname string, hosts []*MxHostSummary) *DualStackReport {
+	var ipv4Hosts, ipv6Hosts []*MxHostSummary
+	for _, host := range hosts {
+		if host.IsTransientError() {
+			continue
+		}
+		if host.address.To4() != nil {
+			ipv4Hosts = append(ipv4Hosts, host)
+		} else {
+			ipv6Hosts = append(ipv6Hosts, host)
+		}
+	}
+	if len(ipv4Hosts) == 0 || len(ipv6Hosts) == 0 {
+		return nil
+	}
+
+	ipv4 := newFamilySummary(ipv4Hosts)
+	ipv6 := newFamilySummary(ipv6Hosts)
+
+	report := &DualStackReport{
+		Hostname:    hostname,
+		Differences: make([]string, 0),
+		Updated:     time.Now().UTC(),
+	}
+
+	if ipv4.reachable != ipv6.reachable {
+		report.Differences = append(report.Differences, "reachable")
+	}
+	if ipv4.starttls != ipv6.starttls {
+		report.Differences = append(report.Differences, "starttls")
+	}
+	if ipv4.starttls && ipv6.starttls {
+		if !ipv4.fingerprints.Equal(ipv6.fingerprints) {
+			report.Differences = append(report.Differences, "certificate")
+		}
+		if ipv4.trusted != ipv6.trusted {
+			report.Differences = append(report.Differences, "trust")
+		}
+		if !ipv4.versions.Equal(ipv6.versions) {
+			report.Differences = append(report.Differences, "tls-versions")
+		}
+	}
+
+	// Which family is weaker?
+	rank4, rank6 := ipv4.rank(), ipv6.rank()
+	for i := range rank4 {
+		if rank4[i] < rank6[i] {
+			report.Weaker = familyIPv4
+			break
+		}
+		if rank4[i] > rank6[i] {
+			report.Weaker = familyIPv6
+			break
+		}
+	}
+
+	return report
+}
+
+// The differences between the IPv4 and IPv6 hosts, nil if not dual-stack
+func (record *TxtRecord) DualStackDifferences() []string {
+	if record.dualStack == nil {
+		return nil
+	}
+	return record.dualStack.Differences
+}
+
+// Remembers the latest report of a MX hostname with differences
+func (proc *MxProcessor) setDualStackReport(hostname string, report *DualStackReport) {
+	proc.dualStackMutex.Lock()
+	defer proc.dualStackMutex.Unlock()
+
+	if report == nil || len(report.Differences) == 0 {
+		delete(proc.dualStack, hostname)
+	} else {
+		proc.dualStack[hostname] = report
+	}
+}
+
+// Returns the MX hostnames with inconsistent IPv4 and IPv6 hosts as JSON
+func (proc *MxProcessor) dualStackStatus() ([]byte, error) {
+	proc.dualStackMutex.Lock()
+	reports := make([]*DualStackReport, 0, len(proc.dualStack))
+	for _, report := range proc.dualStack {
+		reports = append(reports, report)
+	}
+	proc.dualStackMutex.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Hostname < reports[j].Hostname
+	})
+
+	return json.Marshal(reports)
+}
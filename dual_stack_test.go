@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/deckarep/golang-set"
+	"github.com/zmap/zgrab/ztools/x509"
+	"net"
+	"strings"
+	"testing"
+)
+
+func dualStackHost(address string, starttls bool, versions ...string) *MxHostSummary {
+	host := &MxHostSummary{
+		address:  net.ParseIP(address),
+		Starttls: &starttls,
+	}
+	if starttls {
+		host.certificates = []*x509.Certificate{&x509.Certificate{}}
+		host.fingerprints = [][]byte{[]byte("fingerprint")}
+		host.tlsVersions = mapset.NewThreadUnsafeSet()
+		for _, version := range versions {
+			host.tlsVersions.Add(version)
+		}
+	}
+	return host
+}
+
+func TestCompareDualStack(t *testing.T) {
+	if report := compareDualStack("mx.example.com", []*MxHostSummary{dualStackHost("192.0.2.1", true, "\x03\x03")}); report != nil {
+		t.Fatal("single stack should not be compared")
+	}
+
+	report := compareDualStack("mx.example.com", []*MxHostSummary{
+		dualStackHost("192.0.2.1", true, "\x03\x03"),
+		dualStackHost("2001:db8::1", false),
+	})
+	if strings.Join(report.Differences, ",") != "starttls" || report.Weaker != familyIPv6 {
+		t.Fatal("unexpected report:", report)
+	}
+
+	report = compareDualStack("mx.example.com", []*MxHostSummary{
+		dualStackHost("192.0.2.1", true, "\x03\x01"),
+		dualStackHost("2001:db8::1", true, "\x03\x03", "\x03\x01"),
+	})
+	if strings.Join(report.Differences, ",") != "tls-versions" || report.Weaker != familyIPv4 {
+		t.Fatal("unexpected report:", report)
+	}
+
+	report = compareDualStack("mx.example.com", []*MxHostSummary{
+		dualStackHost("192.0.2.1", true, "\x03\x03"),
+		dualStackHost("2001:db8::1", true, "\x03\x03"),
+	})
+	if len(report.Differences) != 0 || report.Weaker != "" {
+		t.Fatal("unexpected report:", report)
+	}
+
+	// The IPv6 host has timed out
+	class := errorConnectTimeout
+	report = compareDualStack("mx.example.com", []*MxHostSummary{
+		dualStackHost("192.0.2.1", true, "\x03\x03"),
+		&MxHostSummary{address: net.ParseIP("2001:db8::1"), ErrorClass: &class},
+	})
+	if report != nil {
+		t.Fatal("transient errors should not be compared:", report)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/zmap/zgrab/ztools/x509"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A leaf and an intermediate certificate signed by a self-signed root
+type fakeChain struct {
+	certificate tls.Certificate // the leaf and the intermediate
+	root        *stdx509.Certificate
+}
+
+// Creates a chain for the given names that expires at notAfter
+func newFakeChain(t *testing.T, notAfter time.Time, names ...string) *fakeChain {
+	notBefore := notAfter.Add(-365 * 24 * time.Hour)
+	if now := time.Now(); notBefore.After(now) {
+		notBefore = now.Add(-time.Hour)
+	}
+
+	serial := int64(0)
+	create := func(template *stdx509.Certificate, parent *stdx509.Certificate, parentKey *ecdsa.PrivateKey) (*stdx509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+
+		serial++
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = notBefore
+		template.NotAfter = notAfter
+
+		der, err := stdx509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := stdx509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+
+	ca := func(name string) *stdx509.Certificate {
+		return &stdx509.Certificate{
+			Subject:               pkix.Name{CommonName: name},
+			KeyUsage:              stdx509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+	}
+
+	root, rootKey := create(ca("Fake Root"), nil, nil)
+	intermediate, intermediateKey := create(ca("Fake Intermediate"), root, rootKey)
+	leaf, leafKey := create(&stdx509.Certificate{
+		Subject:     pkix.Name{CommonName: names[0]},
+		DNSNames:    names,
+		KeyUsage:    stdx509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth},
+	}, intermediate, intermediateKey)
+
+	return &fakeChain{
+		certificate: tls.Certificate{
+			Certificate: [][]byte{leaf.Raw, intermediate.Raw},
+			PrivateKey:  leafKey,
+			Leaf:        leaf,
+		},
+		root: root,
+	}
+}
+
+// Trusts the root of the chain until the returned function is called
+func (chain *fakeChain) trust(t *testing.T) func() {
+	root, err := x509.ParseCertificate(chain.root.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := certificateRoots
+	certificateRoots = x509.NewCertPool()
+	certificateRoots.AddCert(root)
+
+	return func() {
+		certificateRoots = old
+	}
+}
+
+// An in-process SMTP server on a loopback port
+type fakeSmtpServer struct {
+	Greeting      string   // nothing is sent if empty
+	Extensions    []string // announced in the EHLO response
+	TlsExtensions []string // announced in the EHLO response over TLS only
+	Starttls      bool     // STARTTLS is announced and accepted
+	MinVersion    uint16
+	MaxVersion    uint16
+	CipherSuites  []uint16 // nil for the defaults of crypto/tls
+	Chain         *fakeChain
+
+	listener net.Listener
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+	sync.Mutex
+}
+
+// Listens on a random port of the loopback address ("127.0.0.1" or "::1")
+func (server *fakeSmtpServer) Start(t *testing.T, address string) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.listener = listener
+	server.conns = make(map[net.Conn]bool)
+
+	server.wg.Add(1)
+	go func() {
+		defer server.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.Lock()
+			server.conns[conn] = true
+			server.Unlock()
+
+			server.wg.Add(1)
+			go server.serve(conn)
+		}
+	}()
+}
+
+// Stops listening and closes all connections
+func (server *fakeSmtpServer) Close() {
+	server.listener.Close()
+	server.Lock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.Unlock()
+	server.wg.Wait()
+}
+
+// The target of the server with the name sent via SNI
+func (server *fakeSmtpServer) Target(serverName string) *ScanTarget {
+	addr := server.listener.Addr().(*net.TCPAddr)
+	return &ScanTarget{Address: addr.IP, Port: uint16(addr.Port), ServerName: serverName}
+}
+
+func (server *fakeSmtpServer) serve(conn net.Conn) {
+	defer func() {
+		server.Lock()
+		delete(server.conns, conn)
+		server.Unlock()
+		conn.Close()
+		server.wg.Done()
+	}()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	text := textproto.NewConn(conn)
+	tlsActive := false
+
+	if server.Greeting == "" {
+		// Wait until the client gives up
+		text.ReadLine()
+		return
+	}
+	text.PrintfLine("%s", server.Greeting)
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch command {
+		case "EHLO":
+			lines := append([]string{"localhost"}, server.Extensions...)
+			if server.Starttls && !tlsActive {
+				lines = append(lines, "STARTTLS")
+			}
+			if tlsActive {
+				lines = append(lines, server.TlsExtensions...)
+			}
+			for i, line := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				text.PrintfLine("250%s%s", sep, line)
+			}
+		case "STARTTLS":
+			if !server.Starttls || tlsActive {
+				text.PrintfLine("502 5.5.1 Command not implemented")
+				continue
+			}
+			text.PrintfLine("220 2.0.0 Ready to start TLS")
+
+			tlsConn := tls.Server(conn, &tls.Config{
+				Certificates: []tls.Certificate{server.Chain.certificate},
+				MinVersion:   server.MinVersion,
+				MaxVersion:   server.MaxVersion,
+				CipherSuites: server.CipherSuites,
+			})
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			text = textproto.NewConn(tlsConn)
+			tlsActive = true
+		case "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			text.PrintfLine("500 5.5.2 Command unrecognized")
+		}
+	}
+}
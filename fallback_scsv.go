@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// Signals a downgraded handshake (RFC 7507)
+	fallbackSCSV = 0x5600
+
+	recordTypeAlert     = 21
+	recordTypeHandshake = 22
+
+	handshakeTypeClientHello = 1
+	handshakeTypeServerHello = 2
+
+	alertInappropriateFallback = 86
+)
+
+// Connects with the second highest version and TLS_FALLBACK_SCSV.
+// The ClientHello is written by hand as the scanner backends
+// do not send unknown cipher suites. Returns nil if the result is inconclusive.
+func (summary *MxHostSummary) rejectsFallback(target *ScanTarget, versions []uint16) *bool {
+	var highest, fallback uint16
+	for _, version := range versions {
+		if highest == 0 && summary.HasTLSVersion(version) {
+			highest = version
+		} else if highest != 0 && version < versionTLS13 {
+			fallback = version
+			break
+		}
+	}
+	if fallback == 0 {
+		return nil
+	}
+
+	return sendFallbackHello(target, time.Duration(hostTimeout)*time.Second, zlibConfig.EHLODomain, fallback)
+}
+
+// Sends the ClientHello and reads the first record of the response
+func sendFallbackHello(target *ScanTarget, timeout time.Duration, ehloDomain string, version uint16) *bool {
+	var conn net.Conn
+	var err error
+	if target.ImplicitTLS() {
+		if conn, err = dialFrom(target.Source, target.HostPort(), timeout); err != nil {
+			return nil
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+	} else if conn, err = smtpStarttls(target, timeout, ehloDomain, &smtpConn{}); err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	suites := append(legacyCipherSuites(), fallbackSCSV)
+	if _, err = conn.Write(clientHelloRecord(version, suites, target.ServerName)); err != nil {
+		return nil
+	}
+
+	// Record type, version, length and the first byte of the content
+	header := make([]byte, 7)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return nil
+	}
+
+	rejected := false
+	switch {
+	case header[0] == recordTypeAlert && header[6] == alertInappropriateFallback:
+		rejected = true
+	case header[0] == recordTypeHandshake && header[5] == handshakeTypeServerHello:
+		rejected = false
+	default:
+		return nil
+	}
+	return &rejected
+}
+
+// Builds a handshake record with a ClientHello
+func clientHelloRecord(version uint16, cipherSuites []uint16, serverName string) []byte {
+	extensions := make([]byte, 0)
+
+	// server_name
+	if serverName != "" {
+		entry := appendUint16([]byte{0}, uint16(len(serverName)), []byte(serverName)...)
+		extensions = appendExtension(extensions, 0x0000, appendUint16(nil, uint16(len(entry)), entry...))
+	}
+
+	// supported_groups: x25519, secp256r1, secp384r1
+	extensions = appendExtension(extensions, 0x000a, []byte{0, 6, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18})
+
+	// ec_point_formats: uncompressed
+	extensions = appendExtension(extensions, 0x000b, []byte{1, 0})
+
+	// signature_algorithms: ECDSA and RSA with SHA-256, SHA-384 and SHA-1
+	extensions = appendExtension(extensions, 0x000d, []byte{0, 12, 0x04, 0x03, 0x05, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x01, 0x02, 0x01})
+
+	hello := appendUint16(nil, version)
+	random := make([]byte, 32)
+	rand.Read(random)
+	hello = append(hello, random...)
+	hello = append(hello, 0) // no session id
+
+	suites := make([]byte, 0, 2*len(cipherSuites))
+	for _, suite := range cipherSuites {
+		suites = appendUint16(suites, suite)
+	}
+	hello = appendUint16(hello, uint16(len(suites)), suites...)
+	hello = append(hello, 1, 0) // no compression
+	hello = appendUint16(hello, uint16(len(extensions)), extensions...)
+
+	handshake := []byte{handshakeTypeClientHello, byte(len(hello) >> 16), byte(len(hello) >> 8), byte(len(hello))}
+	handshake = append(handshake, hello...)
+
+	// The record version stays at TLS 1.0 for compatibility
+	record := []byte{recordTypeHandshake, 0x03, 0x01}
+	return appendUint16(record, uint16(len(handshake)), handshake...)
+}
+
+// Appends a big-endian uint16 followed by the data
+func appendUint16(buffer []byte, value uint16, data ...byte) []byte {
+	var encoded [2]byte
+	binary.BigEndian.PutUint16(encoded[:], value)
+	return append(append(buffer, encoded[:]...), data...)
+}
+
+func appendExtension(buffer []byte, extension uint16, data []byte) []byte {
+	return appendUint16(appendUint16(buffer, extension), uint16(len(data)), data...)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/zmap/zgrab/ztools/x509"
+	"github.com/zmap/zgrab/ztools/ztls"
+	"time"
+)
+
+const (
+	curveTypeNamedCurve = 3
+)
+
+// Scanner backend using crypto/tls, supports TLS 1.3
+type GoScanner struct {
+	Timeout    time.Duration
+	EHLODomain string
+}
+
+func (scanner *GoScanner) Versions() []uint16 {
+	return []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+}
+
+// The TLS 1.3 cipher suites can not be configured in crypto/tls
+func (scanner *GoScanner) CipherSuites() []uint16 {
+	return allCipherSuites()
+}
+
+// crypto/tls sends the suites in its own order of preference
+func (scanner *GoScanner) KeepsCipherOrder() bool {
+	return false
+}
+
+func (scanner *GoScanner) Grab(target *ScanTarget, tlsVersion uint16, cipherSuites []uint16) *MxHostGrab {
+	result := &MxHostGrab{}
+
+	if cipherSuites == nil {
+		cipherSuites = allCipherSuites()
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: true, // the chain is validated by CertificateValidity
+		MinVersion:         tls.VersionTLS10,
+		MaxVersion:         tlsVersion,
+		CipherSuites:       cipherSuites,
+		ServerName:         target.ServerName,
+	}
+
+	// Answer certificate requests with an empty certificate
+	clientCertRequested := false
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		clientCertRequested = true
+		return &tls.Certificate{}, nil
+	}
+
+	var conn *smtpConn
+	var err error
+
+	if target.ImplicitTLS() {
+		conn, err = dialImplicitTLS(target, scanner.Timeout, scanner.EHLODomain, config)
+	} else {
+		conn, err = dialStarttls(target, scanner.Timeout, scanner.EHLODomain, config)
+	}
+	result.sourceAddress = conn.localAddress
+	result.starttls = conn.starttls
+	result.banner = conn.banner
+	result.ehlo = conn.ehlo
+	result.tlsEhlo = conn.tlsEhlo
+	if err != nil {
+		msg := simplifyError(err).Error()
+		class := classifyError(stageConnect, err)
+		result.Error = &msg
+		result.errorClass = &class
+		return result
+	}
+	defer conn.tls.Close()
+
+	state := conn.tls.ConnectionState()
+	result.tlsVersion = ztls.TLSVersion(state.Version)
+	result.tlsCipherSuite = ztls.CipherSuite(state.CipherSuite)
+	result.scts = state.SignedCertificateTimestamps
+	result.clientCertRequested = &clientCertRequested
+
+	// The negotiated group
+	if state.CurveID != 0 {
+		result.dhParams = &ztls.ECDHEParams{
+			CurveType:       curveTypeNamedCurve,
+			CurveID:         ztls.CurveID(state.CurveID),
+			PublicKeyLength: curveKeyLengths[uint16(state.CurveID)],
+		}
+	}
+
+	// Parse the certificates with zgrab
+	certs := make([]*x509.Certificate, 0, len(state.PeerCertificates))
+	for _, peerCert := range state.PeerCertificates {
+		cert, err := x509.ParseCertificate(peerCert.Raw)
+		if err != nil {
+			msg := err.Error()
+			class := errorCertificateParse
+			result.Error = &msg
+			result.errorClass = &class
+			return result
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) > 0 {
+		result.certificates = certs
+	}
+
+	return result
+}
+
+// All cipher suites implemented by crypto/tls, including the insecure ones
+func allCipherSuites() []uint16 {
+	suites := make([]uint16, 0)
+	for _, suite := range tls.CipherSuites() {
+		suites = append(suites, suite.ID)
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites = append(suites, suite.ID)
+	}
+	return suites
+}
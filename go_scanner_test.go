@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoScannerWithoutStarttls(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost ESMTP\r\n"))
+		reader.ReadString('\n')
+		conn.Write([]byte("250-localhost\r\n250 PIPELINING\r\n"))
+		reader.ReadString('\n')
+	}()
+
+	scanner := &GoScanner{
+		Timeout:    time.Second,
+		EHLODomain: "localhost",
+	}
+	target := &ScanTarget{
+		Address: net.ParseIP("127.0.0.1"),
+		Port:    uint16(listener.Addr().(*net.TCPAddr).Port),
+		Source:  net.ParseIP("127.0.0.1"),
+	}
+	result := scanner.Grab(target, versionTLS13, nil)
+
+	if result.starttls == nil || *result.starttls {
+		t.Fatal("host should not have starttls")
+	}
+	if result.certificates != nil {
+		t.Fatal("nil expected")
+	}
+	if result.errorClass == nil || *result.errorClass != errorStarttlsUnsupported {
+		t.Fatal("unexpected error class:", result.errorClass)
+	}
+	if !result.sourceAddress.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatal("unexpected source address:", result.sourceAddress)
+	}
+	if result.banner == nil || *result.banner != "220 localhost ESMTP" {
+		t.Fatal("unexpected banner:", result.banner)
+	}
+	if result.ehlo == nil || *result.ehlo != "250-localhost\r\n250 PIPELINING" {
+		t.Fatal("unexpected EHLO response:", result.ehlo)
+	}
+}
+
+func TestParseEhloResponse(t *testing.T) {
+	response := "250-mx.example.com\r\n250-SIZE 52428800\r\n250-pipelining\r\n250-8BITMIME\r\n250-AUTH PLAIN LOGIN\r\n250-AUTH=LOGIN CRAM-MD5\r\n250 REQUIRETLS"
+	extensions, mechanisms := parseEhloResponse(response)
+
+	if expected := "SIZE,PIPELINING,8BITMIME,AUTH,REQUIRETLS"; strings.Join(extensions, ",") != expected {
+		t.Fatal("unexpected extensions:", extensions)
+	}
+	if expected := "PLAIN,LOGIN,CRAM-MD5"; strings.Join(mechanisms, ",") != expected {
+		t.Fatal("unexpected mechanisms:", mechanisms)
+	}
+	if !ehloHasExtension(response, "requiretls") {
+		t.Fatal("REQUIRETLS expected")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"golang.org/x/net/publicsuffix"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of a single network or provider
+type limiterConfig struct {
+	maxActive   int           // concurrent host checks, 0 for unlimited
+	minInterval time.Duration // between two starts, 0 for unlimited
+}
+
+type limiterSlot struct {
+	config    *limiterConfig
+	active    int
+	lastStart time.Time
+	waiting   []func() // called when a host check has finished
+}
+
+// Limits the concurrent host checks and their rate per IPv4 /24,
+// IPv6 /48 and MX provider. Deferred jobs do not occupy a worker.
+type HostLimiter struct {
+	network  limiterConfig
+	provider limiterConfig
+
+	slots  map[string]*limiterSlot
+	parked map[string]bool // deferred jobs
+	wg     sync.WaitGroup  // waits for the deferred jobs
+	sync.Mutex
+}
+
+// Rates are given in host checks per minute, zero values disable the limit
+func NewHostLimiter(networkActive uint, networkRate uint, providerActive uint, providerRate uint) *HostLimiter {
+	config := func(active uint, rate uint) (c limiterConfig) {
+		c.maxActive = int(active)
+		if rate > 0 {
+			c.minInterval = time.Minute / time.Duration(rate)
+		}
+		return
+	}
+
+	return &HostLimiter{
+		network:  config(networkActive, networkRate),
+		provider: config(providerActive, providerRate),
+		slots:    make(map[string]*limiterSlot),
+		parked:   make(map[string]bool),
+	}
+}
+
+// Tries to start the job with the given key. If a network or the provider
+// is busy, retry is called later from another goroutine and false is returned.
+func (limiter *HostLimiter) Acquire(key string, target *ScanTarget, retry func()) bool {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	now := time.Now()
+	slots := limiter.targetSlots(target)
+
+	for _, slot := range slots {
+		config := slot.config
+		if config.maxActive > 0 && slot.active >= config.maxActive {
+			slot.waiting = append(slot.waiting, retry)
+			limiter.park(key)
+			return false
+		}
+		if wait := slot.lastStart.Add(config.minInterval).Sub(now); wait > 0 {
+			time.AfterFunc(wait, retry)
+			limiter.park(key)
+			return false
+		}
+	}
+
+	for _, slot := range slots {
+		slot.active++
+		slot.lastStart = now
+	}
+
+	if limiter.parked[key] {
+		delete(limiter.parked, key)
+		limiter.wg.Done()
+	}
+	return true
+}
+
+// Marks the job as finished and wakes up a waiting job
+func (limiter *HostLimiter) Release(target *ScanTarget) {
+	wakeUp := make([]func(), 0)
+
+	limiter.Lock()
+	for name, slot := range limiter.namedSlots(target) {
+		slot.active--
+		if len(slot.waiting) > 0 {
+			wakeUp = append(wakeUp, slot.waiting[0])
+			slot.waiting = slot.waiting[1:]
+		} else if slot.active == 0 && time.Since(slot.lastStart) >= slot.config.minInterval {
+			delete(limiter.slots, name)
+		}
+	}
+	limiter.Unlock()
+
+	for _, retry := range wakeUp {
+		retry()
+	}
+}
+
+// Waits until all deferred jobs have been started
+func (limiter *HostLimiter) Wait() {
+	limiter.wg.Wait()
+}
+
+func (limiter *HostLimiter) park(key string) {
+	if !limiter.parked[key] {
+		limiter.parked[key] = true
+		limiter.wg.Add(1)
+	}
+}
+
+func (limiter *HostLimiter) targetSlots(target *ScanTarget) []*limiterSlot {
+	slots := make([]*limiterSlot, 0, 2)
+	for _, slot := range limiter.namedSlots(target) {
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+// Returns the slots of the network and the provider, creates missing ones
+func (limiter *HostLimiter) namedSlots(target *ScanTarget) map[string]*limiterSlot {
+	result := make(map[string]*limiterSlot)
+
+	add := func(name string, config *limiterConfig) {
+		if config.maxActive == 0 && config.minInterval == 0 {
+			return
+		}
+		slot, ok := limiter.slots[name]
+		if !ok {
+			slot = &limiterSlot{config: config}
+			limiter.slots[name] = slot
+		}
+		result[name] = slot
+	}
+
+	add("net:"+networkName(target.Address), &limiter.network)
+	if provider := providerName(target.ServerName); provider != "" {
+		add("mx:"+provider, &limiter.provider)
+	}
+
+	return result
+}
+
+// The /24 of an IPv4 or the /48 of an IPv6 address
+func networkName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// Approximates the provider by the registered domain of the MX hostname,
+// e.g. example.co.uk for mx.example.co.uk
+func providerName(hostname string) string {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(strings.ToLower(hostname), "."))
+	if err != nil {
+		return ""
+	}
+	return domain
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHostLimiter(t *testing.T) {
+	limiter := NewHostLimiter(1, 0, 0, 0)
+	target := func(ip string) *ScanTarget {
+		return &ScanTarget{Address: net.ParseIP(ip), Port: portSMTP}
+	}
+	retried := false
+
+	if !limiter.Acquire("a", target("192.0.2.1"), nil) {
+		t.Fatal("first job should start")
+	}
+	if limiter.Acquire("b", target("192.0.2.2"), func() { retried = true }) {
+		t.Fatal("second job in the same /24 should be deferred")
+	}
+	if !limiter.Acquire("c", target("198.51.100.1"), nil) {
+		t.Fatal("job in another network should start")
+	}
+
+	limiter.Release(target("192.0.2.1"))
+	if !retried {
+		t.Fatal("deferred job should be retried")
+	}
+	if !limiter.Acquire("b", target("192.0.2.2"), nil) {
+		t.Fatal("retried job should start")
+	}
+	limiter.Wait()
+}
+
+func TestNetworkAndProviderName(t *testing.T) {
+	if name := networkName(net.ParseIP("192.0.2.77")); name != "192.0.2.0/24" {
+		t.Fatal("unexpected value:", name)
+	}
+	if name := networkName(net.ParseIP("2001:db8:1:2::1")); name != "2001:db8:1::/48" {
+		t.Fatal("unexpected value:", name)
+	}
+	if name := providerName("ASPMX.L.Google.com."); name != "google.com" {
+		t.Fatal("unexpected value:", name)
+	}
+	if name := providerName("mx1.example.co.uk"); name != "example.co.uk" {
+		t.Fatal("unexpected value:", name)
+	}
+	if name := providerName("co.uk"); name != "" {
+		t.Fatal("unexpected value:", name)
+	}
+}
@@ -1,47 +1,159 @@
 package main
 
 import (
+	"log"
+	"math/rand"
 	"net"
 	"time"
 )
 
+// Cache outcomes of host checks
+const (
+	outcomeUnreachable = "unreachable"
+	outcomeFailed      = "failed"
+)
+
 type HostProcessor struct {
-	cache *CachedWorkerPool
+	cache   *CachedWorkerPool
+	limiter *HostLimiter // optional
 }
 
 func NewHostProcessor(workersCount uint, cacheConfig *CacheConfig) *HostProcessor {
+	proc := &HostProcessor{
+		limiter: hostLimiter,
+	}
+
 	workerFunc := func(obj interface{}) {
 		entry, _ := obj.(*CacheEntry)
+		target := parseHostKey(entry.Key)
+
+		// Start the reverse lookup
+		var ptr *DnsJob
+		if dnsProcessor != nil {
+			ptr = dnsProcessor.NewJob(reverseName(target.Address), TypePTR)
+		}
 
 		// Run the host check
-		hostSummary := NewMxHostSummary(net.IP(entry.Key))
+		hostSummary := NewMxHostSummary(target)
+		if ptr != nil {
+			hostSummary.ptrNames = ptr.Results()
+		}
+
+		// Retry transient errors and keep the previous result meanwhile
+		if hostSummary.IsTransientError() && entry.Retries < hostRetries {
+			entry.Retries++
+			proc.cache.RetryAfter(entry, retryDelay(entry.Retries))
+			if previous, ok := entry.Value.(*MxHostSummary); ok && !previous.IsTransientError() {
+				return
+			}
+		} else {
+			entry.Retries = 0
+		}
+
 		entry.Value = hostSummary
 
-		// Enqueue the result to store it in the database
-		if resultProcessor != nil {
-			resultProcessor.Add(hostSummary)
-			if certs := hostSummary.certificates; certs != nil {
-				resultProcessor.Add(certs)
+		// Keep the raw grabs for a later reanalysis
+		if transcriptArchive != nil {
+			if err := transcriptArchive.Save(hostSummary); err != nil {
+				log.Println("Unable to archive transcript:", err)
 			}
 		}
+
+		saveHostSummary(hostSummary)
 	}
 
-	proc := &HostProcessor{
-		cache: NewCachedWorkerPool(workersCount, workerFunc, cacheConfig),
+	proc.cache = NewCachedWorkerPool(workersCount, workerFunc, cacheConfig)
+	proc.cache.outcomeFunc = hostOutcome
+
+	// Politeness limits per network and provider
+	if limiter := proc.limiter; limiter != nil {
+		proc.cache.admit = func(entry *CacheEntry) bool {
+			return limiter.Acquire(entry.Key, parseHostKey(entry.Key), func() {
+				proc.cache.requeue(entry)
+			})
+		}
+		proc.cache.release = func(entry *CacheEntry) {
+			limiter.Release(parseHostKey(entry.Key))
+		}
 	}
 
 	return proc
 }
 
-func (proc *HostProcessor) NewJobWithAccessTime(addr net.IP, accessed time.Time) *CacheEntry {
-	return proc.cache.NewJob(string(addr), accessed)
+func (proc *HostProcessor) NewJobWithAccessTime(target *ScanTarget, accessed time.Time) *CacheEntry {
+	return proc.cache.NewJob(hostKey(target), accessed)
 }
 
+// Creates a job for the SMTP port without SNI
 func (proc *HostProcessor) NewJob(addr net.IP) *CacheEntry {
-	return proc.NewJobWithAccessTime(addr, time.Now())
+	return proc.NewJobWithAccessTime(&ScanTarget{Address: addr, Port: portSMTP}, time.Now())
+}
+
+// Creates jobs for the additional ports without waiting for them
+func (proc *HostProcessor) NewAdditionalJobs(addr net.IP, serverName string, accessed time.Time) {
+	for _, port := range hostPorts {
+		if port != portSMTP {
+			proc.NewJobWithAccessTime(&ScanTarget{Address: addr, Port: port, ServerName: serverName}, accessed)
+		}
+	}
+}
+
+// Enqueues the result to store it in the database
+// Replaces the validity of a cached host check with the same server certificate
+func (proc *HostProcessor) setValidity(target *ScanTarget, validity *CertificateValidity) {
+	summary, ok := proc.cache.Get(hostKey(target)).(*MxHostSummary)
+	if ok && len(summary.certificates) > 0 && summary.certificates[0].Equal(validity.Certificates[0]) {
+		summary.validity = validity
+	}
+}
+
+func saveHostSummary(summary *MxHostSummary) {
+	if resultProcessor != nil {
+		resultProcessor.Add(summary)
+		if certs := summary.certificates; certs != nil {
+			resultProcessor.Add(certs)
+		}
+	}
+}
+
+// Unreachable hosts and permanent failures have their own cache policies
+func hostOutcome(entry *CacheEntry) string {
+	summary, ok := entry.Value.(*MxHostSummary)
+	switch {
+	case !ok:
+		return ""
+	case summary.IsTransientError():
+		return outcomeUnreachable
+	case summary.IsPermanentError():
+		return outcomeFailed
+	}
+	return ""
+}
+
+// Exponential backoff with jitter: the n-th retry waits
+// between 0.5 and 1.5 times hostRetryDelay * 2^(n-1)
+func retryDelay(retry uint) time.Duration {
+	delay := time.Duration(hostRetryDelay) * time.Second << (retry - 1)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+}
+
+// The cache key consists of the 16 byte address, the port and the server name
+func hostKey(target *ScanTarget) string {
+	return string(target.Address.To16()) + string([]byte{byte(target.Port >> 8), byte(target.Port)}) + target.ServerName
+}
+
+func parseHostKey(key string) *ScanTarget {
+	return &ScanTarget{
+		Address:    net.IP(key[:net.IPv6len]),
+		Port:       uint16(key[net.IPv6len])<<8 | uint16(key[net.IPv6len+1]),
+		ServerName: key[net.IPv6len+2:],
+	}
 }
 
 // Stops accepting new jobs and waits until all jobs are finished
 func (proc *HostProcessor) Close() {
+	if proc.limiter != nil {
+		proc.limiter.Wait()
+	}
 	proc.cache.Close()
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"github.com/hashicorp/golang-lru"
+	"github.com/zmap/zgrab/ztools/x509"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHostConcurrency(t *testing.T) {
@@ -46,6 +49,42 @@ func TestHostCache(t *testing.T) {
 	processor.Close()
 }
 
+func TestHostSetValidity(t *testing.T) {
+	processor := NewHostProcessor(1, NewCacheConfig(600, 0, 60))
+	defer processor.Close()
+
+	certA := &x509.Certificate{Raw: []byte("a")}
+	certB := &x509.Certificate{Raw: []byte("b")}
+	target := &ScanTarget{Address: net.ParseIP("192.0.2.1"), Port: portSMTP, ServerName: "mx.example.com"}
+	summary := &MxHostSummary{certificates: []*x509.Certificate{certA}}
+	processor.cache.Set(hostKey(target), summary)
+
+	// Only the validity of the same server certificate is replaced
+	processor.setValidity(target, &CertificateValidity{Certificates: []*x509.Certificate{certB}})
+	if summary.validity != nil {
+		t.Fatal("validity of another certificate set")
+	}
+	validity := &CertificateValidity{Certificates: []*x509.Certificate{certA}}
+	processor.setValidity(target, validity)
+	if summary.validity != validity {
+		t.Fatal("validity not set")
+	}
+}
+
+func TestCacheRefresh(t *testing.T) {
+	var calls int32
+	pool := NewCachedWorkerPool(1, func(obj interface{}) {
+		atomic.AddInt32(&calls, 1)
+	}, NewCacheConfig(600, 0, 60))
+	defer pool.Close()
+
+	pool.NewJob("key", time.Now()).Wait()
+	pool.Refresh("key").Wait()
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatal("unexpected number of calls:", n)
+	}
+}
+
 func TestLruCache(t *testing.T) {
 	cache, _ := lru.New(10)
 	targetA := string(net.ParseIP("127.0.0.1"))
@@ -61,3 +100,84 @@ func TestLruCache(t *testing.T) {
 	}
 
 }
+
+func TestHostKey(t *testing.T) {
+	target := parseHostKey(hostKey(&ScanTarget{Address: net.ParseIP("192.0.2.1"), Port: portSubmission}))
+	if target.String() != "192.0.2.1:587" {
+		t.Fatal("unexpected value:", target)
+	}
+
+	target = parseHostKey(hostKey(&ScanTarget{Address: net.ParseIP("2001:db8::1"), Port: portSMTP, ServerName: "mx.example.com"}))
+	if target.String() != "[2001:db8::1]:25/mx.example.com" {
+		t.Fatal("unexpected value:", target)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for retry := uint(1); retry <= 3; retry++ {
+		base := time.Duration(hostRetryDelay) * time.Second << (retry - 1)
+		if delay := retryDelay(retry); delay < base/2 || delay > base*3/2 {
+			t.Fatal("delay out of range:", retry, delay)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	calls := 0
+	var pool *CachedWorkerPool
+	pool = NewCachedWorkerPool(1, func(obj interface{}) {
+		entry := obj.(*CacheEntry)
+		calls++
+		if entry.Retries < 2 {
+			entry.Retries++
+			pool.RetryAfter(entry, time.Millisecond)
+		}
+	}, nil)
+
+	pool.NewJob("key", time.Now())
+	pool.Close()
+
+	if calls != 3 {
+		t.Fatal("unexpected number of calls:", calls)
+	}
+}
+
+func TestHostOutcomePolicy(t *testing.T) {
+	config := NewCacheConfig(3600, 0, 60)
+	config.AddOutcome(outcomeUnreachable, 3600, 600)
+
+	timeout := errorConnectTimeout
+	refused := errorConnectRefused
+	entry := &CacheEntry{Value: &MxHostSummary{ErrorClass: &timeout}}
+
+	if outcome := hostOutcome(entry); outcome != outcomeUnreachable {
+		t.Fatal("unexpected outcome:", outcome)
+	}
+	if hostOutcome(&CacheEntry{Value: &MxHostSummary{ErrorClass: &refused}}) != outcomeFailed {
+		t.Fatal("refused connection should be a permanent failure")
+	}
+	if hostOutcome(&CacheEntry{Value: &MxHostSummary{}}) != "" {
+		t.Fatal("success should use the default policy")
+	}
+
+	refreshed := time.Now().Add(-time.Hour)
+	if !config.policy(outcomeUnreachable).shouldRefresh(refreshed) {
+		t.Fatal("unreachable host should be refreshed")
+	}
+	if config.policy("").shouldRefresh(refreshed) || config.policy(outcomeFailed).shouldRefresh(refreshed) {
+		t.Fatal("default policy should never refresh")
+	}
+}
+
+func TestMxProcessorForget(t *testing.T) {
+	proc := NewMxProcessor(1, nil)
+	proc.cache.workerFunc = func(obj interface{}) {}
+	proc.AddDomain("mx.example.com", "example.com")
+
+	proc.NewJob("mx.example.com").Wait()
+	proc.Close()
+
+	if domains := proc.Domains("mx.example.com"); domains != nil {
+		t.Fatal("domains should be removed with the entry:", domains)
+	}
+}
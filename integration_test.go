@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs the host checks with the go scanner and restores the globals afterwards
+func useGoScanner() func() {
+	oldScanner, oldVersions := hostScanner, probeVersions
+	hostScanner = &GoScanner{Timeout: 2 * time.Second, EHLODomain: "localhost"}
+	probeVersions, _ = parseTLSVersions("tls1.0,tls1.1,tls1.2,tls1.3")
+
+	return func() {
+		hostScanner, probeVersions = oldScanner, oldVersions
+	}
+}
+
+// Redirects all host checks to the port of a fake server
+type redirectScanner struct {
+	*GoScanner
+	port uint16
+}
+
+func (scanner *redirectScanner) Grab(target *ScanTarget, tlsVersion uint16, cipherSuites []uint16) *MxHostGrab {
+	redirected := *target
+	redirected.Port = scanner.port
+	return scanner.GoScanner.Grab(&redirected, tlsVersion, cipherSuites)
+}
+
+func TestIntegrationStarttls(t *testing.T) {
+	defer useGoScanner()()
+
+	chain := newFakeChain(t, time.Now().Add(24*time.Hour), "mx.example.test")
+	defer chain.trust(t)()
+
+	server := &fakeSmtpServer{
+		Greeting:   "220 mx.example.test ESMTP Postfix",
+		Extensions: []string{"PIPELINING", "SIZE 10240000"},
+		Starttls:   true,
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+		Chain:      chain,
+	}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+
+	summary := NewMxHostSummary(server.Target("mx.example.test"))
+
+	if summary.Error != nil {
+		t.Fatal("unexpected error:", *summary.Error)
+	}
+	if summary.Starttls == nil || !*summary.Starttls {
+		t.Fatal("host should have starttls")
+	}
+	if !summary.HasTLSVersion(tls.VersionTLS13) || !summary.HasTLSVersion(tls.VersionTLS12) || summary.HasTLSVersion(tls.VersionTLS11) {
+		t.Fatal("unexpected TLS versions:", setToStringArrays(summary.tlsVersions))
+	}
+	if len(summary.certificates) != 2 {
+		t.Fatal("leaf and intermediate expected, got", len(summary.certificates))
+	}
+	if !summary.CertificateValidForDomain("mx.example.test") || summary.CertificateValidForDomain("other.example.test") {
+		t.Fatal("unexpected certificate names")
+	}
+	if summary.banner == nil || *summary.banner != server.Greeting {
+		t.Fatal("unexpected banner:", summary.banner)
+	}
+	if !summary.HasExtension("PIPELINING") || !summary.HasExtension("STARTTLS") {
+		t.Fatal("unexpected extensions:", summary.ehloExtensions)
+	}
+	if !summary.sourceAddress.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatal("unexpected source address:", summary.sourceAddress)
+	}
+
+	// The stored validity columns
+	columns := newValidityColumns(summary.validity)
+	rootFingerprint := sha1.Sum(chain.root.Raw)
+	intermediateFingerprint := sha1.Sum(chain.certificate.Certificate[1])
+	if columns.certTrusted == nil || !*columns.certTrusted || columns.certError != nil {
+		t.Fatal("chain should be trusted:", summary.validity.Error)
+	}
+	if columns.rootFingerprint == nil || string(*columns.rootFingerprint) != string(rootFingerprint[:]) {
+		t.Fatal("unexpected root")
+	}
+	if len(columns.intermediateFingerprints) != 1 || string(columns.intermediateFingerprints[0]) != string(intermediateFingerprint[:]) {
+		t.Fatal("unexpected intermediates")
+	}
+	if *columns.certExpired || *columns.chainIncomplete {
+		t.Fatal("chain should be valid and complete")
+	}
+
+	// The published TXT record
+	record := createTxtRecord("mx.example.test", []*MxHostSummary{summary})
+	if !record.starttls || record.certProblems.Cardinality() != 0 || record.problems.Cardinality() != 0 {
+		t.Fatal("unexpected record:", record.String())
+	}
+	if versions := joinSet(record.tlsVersions, true); versions != "0303,0304" && versions != "0304,0303" {
+		t.Fatal("unexpected TLS versions:", versions)
+	}
+	if trusted := joinSet(record.trusted, false); trusted != "system" {
+		t.Fatal("unexpected trust:", trusted)
+	}
+	leafFingerprint := sha1.Sum(chain.certificate.Certificate[0])
+	if str := record.String(); !strings.HasPrefix(str, "starttls=true") || !strings.Contains(str, " fingerprints="+hex.EncodeToString(leafFingerprint[:])+" trusted=system") {
+		t.Fatal("unexpected TXT record:", str)
+	}
+}
+
+func TestIntegrationCipherSuites(t *testing.T) {
+	defer useGoScanner()()
+
+	chain := newFakeChain(t, time.Now().Add(24*time.Hour), "mx.example.test")
+	defer chain.trust(t)()
+
+	server := &fakeSmtpServer{
+		Greeting:     "220 localhost ESMTP",
+		Starttls:     true,
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		Chain:        chain,
+	}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+
+	summary := NewMxHostSummary(server.Target(""))
+
+	if summary.tlsVersions == nil || summary.tlsVersions.Cardinality() != 1 || !summary.HasTLSVersion(tls.VersionTLS12) {
+		t.Fatal("only TLS 1.2 expected")
+	}
+	suite := string([]byte{0xc0, 0x2b})
+	if summary.tlsCipherSuites.Cardinality() != 1 || !summary.tlsCipherSuites.Contains(suite) {
+		t.Fatal("unexpected cipher suites:", setToStringArrays(summary.tlsCipherSuites))
+	}
+	if summary.forwardSecrecy == nil || !*summary.forwardSecrecy {
+		t.Fatal("forward secrecy expected")
+	}
+
+	// The complete TXT record with a single version and cipher suite
+	leafFingerprint := sha1.Sum(chain.certificate.Certificate[0])
+	expected := fmt.Sprintf("starttls=true updated=%d tls-versions=0303 tls-ciphers=c02b fingerprints=%s trusted=system", summary.Updated.Unix(), hex.EncodeToString(leafFingerprint[:]))
+	record := createTxtRecord("mx.example.test", []*MxHostSummary{summary})
+	if str := record.String(); str != expected {
+		t.Fatal("unexpected TXT record:", str)
+	}
+}
+
+func TestIntegrationCipherOrder(t *testing.T) {
+	defer useGoScanner()()
+	defer func(enumerate bool) { enumerateCiphers = enumerate }(enumerateCiphers)
+	enumerateCiphers = true
+
+	// crypto/tls servers follow the client's preference
+	suites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA, tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	server := &fakeSmtpServer{
+		Greeting:     "220 localhost ESMTP",
+		Starttls:     true,
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: suites,
+		Chain:        newFakeChain(t, time.Now().Add(24*time.Hour), "mx.example.test"),
+	}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+
+	summary := NewMxHostSummary(server.Target(""))
+
+	if accepted := summary.acceptedCiphers[tls.VersionTLS12]; len(accepted) != len(suites) {
+		t.Fatal("unexpected accepted suites:", accepted)
+	}
+	if len(summary.AcceptedCipherSuites()) != len(suites) {
+		t.Fatal("unexpected accepted suites:", summary.AcceptedCipherSuites())
+	}
+
+	// The go scanner does not send the suites in the order of the offer
+	if order := summary.CipherOrderStrings(); len(order) != 0 {
+		t.Fatal("cipher order should be unknown:", order)
+	}
+}
+
+func TestIntegrationFallbackSCSV(t *testing.T) {
+	defer useGoScanner()()
+	defer func(probe bool) { probeVulnerabilities = probe }(probeVulnerabilities)
+	probeVulnerabilities = true
+
+	server := &fakeSmtpServer{
+		Greeting:   "220 localhost ESMTP",
+		Starttls:   true,
+		MinVersion: tls.VersionTLS10,
+		MaxVersion: tls.VersionTLS12,
+		Chain:      newFakeChain(t, time.Now().Add(24*time.Hour), "mx.example.test"),
+	}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+
+	// crypto/tls rejects the downgrade to TLS 1.1
+	summary := NewMxHostSummary(server.Target("mx.example.test"))
+	if fallback := summary.vulnerabilities.FallbackSCSV; fallback == nil || !*fallback {
+		t.Fatal("downgrade should be rejected:", fallback)
+	}
+	if problems := summary.vulnerabilities.Problems(); len(problems) != 0 {
+		t.Fatal("unexpected problems:", problems)
+	}
+
+	// The highest version is no downgrade
+	fallback := sendFallbackHello(server.Target("mx.example.test"), time.Second, "localhost", tls.VersionTLS12)
+	if fallback == nil || *fallback {
+		t.Fatal("handshake with the highest version should be accepted:", fallback)
+	}
+}
+
+func TestIntegrationWithoutStarttls(t *testing.T) {
+	defer useGoScanner()()
+
+	server := &fakeSmtpServer{Greeting: "220 localhost ESMTP"}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+
+	summary := NewMxHostSummary(server.Target(""))
+
+	if summary.Starttls == nil || *summary.Starttls {
+		t.Fatal("host should not have starttls")
+	}
+	if summary.ErrorClass == nil || *summary.ErrorClass != errorStarttlsUnsupported {
+		t.Fatal("unexpected error class:", summary.ErrorClass)
+	}
+
+	record := createTxtRecord("mx.example.test", []*MxHostSummary{summary})
+	if str := record.String(); str != "starttls=false" {
+		t.Fatal("unexpected TXT record:", str)
+	}
+}
+
+func TestIntegrationGreeting(t *testing.T) {
+	defer useGoScanner()()
+
+	server := &fakeSmtpServer{Greeting: "421 4.7.0 Try again later"}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+
+	summary := NewMxHostSummary(server.Target(""))
+
+	if summary.Starttls != nil {
+		t.Fatal("starttls should be unknown")
+	}
+	if !summary.IsTransientError() || *summary.ErrorClass != errorGreeting4xx {
+		t.Fatal("unexpected error class:", summary.ErrorClass)
+	}
+}
+
+func TestIntegrationExpiredCertificate(t *testing.T) {
+	defer useGoScanner()()
+
+	server := &fakeSmtpServer{
+		Greeting:   "220 localhost ESMTP",
+		Starttls:   true,
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+		Chain:      newFakeChain(t, time.Now().Add(-24*time.Hour), "mx.example.test"),
+	}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+
+	summary := NewMxHostSummary(server.Target("mx.example.test"))
+
+	if summary.validity == nil || !summary.validity.Expired {
+		t.Fatal("certificate should be expired")
+	}
+
+	record := createTxtRecord("mx.example.test", []*MxHostSummary{summary})
+	if !record.certProblems.Contains("expired") {
+		t.Fatal("unexpected certificate problems:", setToStringArrays(record.certProblems))
+	}
+}
+
+func TestIntegrationDnsServer(t *testing.T) {
+	defer useGoScanner()()
+
+	server := &fakeSmtpServer{
+		Greeting:   "220 mx.example.test ESMTP",
+		Starttls:   true,
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+		Chain:      newFakeChain(t, time.Now().Add(24*time.Hour), "mx.example.test"),
+	}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+	hostScanner = &redirectScanner{hostScanner.(*GoScanner), server.Target("").Port}
+
+	// Resolves the MX hostname to the fake server
+	resolverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &dns.Server{PacketConn: resolverConn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if question := r.Question[0]; question.Name == "mx.example.test." && question.Qtype == dns.TypeA {
+			msg.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("127.0.0.1"),
+			}}
+		}
+		w.WriteMsg(msg)
+	})}
+	go resolver.ActivateAndServe()
+	defer resolver.Shutdown()
+
+	dnsProcessor = NewDnsProcessor(1)
+	dnsProcessor.Configure(resolverConn.LocalAddr().String(), 1)
+	hostProcessor = NewHostProcessor(1, nil)
+	mxProcessor = NewMxProcessor(1, NewCacheConfig(600, 0, 60))
+	defer func() {
+		mxProcessor.Close()
+		hostProcessor.Close()
+		dnsProcessor.Close()
+		mxProcessor, hostProcessor, dnsProcessor = nil, nil, nil
+	}()
+
+	dnsServer := NewDnsServer("127.0.0.1:0", "policy.test")
+	defer dnsServer.Close()
+	serverAddr := dnsServer.Addr()
+
+	// The first queries are not answered until the checks are finished
+	client := &dns.Client{ReadTimeout: 500 * time.Millisecond}
+	query := new(dns.Msg)
+	query.SetQuestion("mx.example.test.policy.test.", dns.TypeTXT)
+
+	for i := 0; i < 20; i++ {
+		response, _, err := client.Exchange(query, serverAddr)
+		if err != nil || len(response.Answer) == 0 {
+			continue
+		}
+		txt := strings.Join(response.Answer[0].(*dns.TXT).Txt, "")
+		if !strings.HasPrefix(txt, "starttls=true") {
+			t.Fatal("unexpected TXT record:", txt)
+		}
+		return
+	}
+	t.Fatal("no TXT record received")
+}
+
+func TestIntegrationExtensionsOverTLS(t *testing.T) {
+	defer useGoScanner()()
+	defer func(old bool) { txtRequireTLS = old }(txtRequireTLS)
+	txtRequireTLS = true
+
+	server := &fakeSmtpServer{
+		Greeting:      "220 localhost ESMTP",
+		Extensions:    []string{"PIPELINING"},
+		TlsExtensions: []string{"REQUIRETLS", "AUTH PLAIN LOGIN"},
+		Starttls:      true,
+		MinVersion:    tls.VersionTLS12,
+		MaxVersion:    tls.VersionTLS13,
+		Chain:         newFakeChain(t, time.Now().Add(24*time.Hour), "mx.example.test"),
+	}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+
+	summary := NewMxHostSummary(server.Target("mx.example.test"))
+
+	if !summary.HasExtension("REQUIRETLS") || !summary.HasExtension("PIPELINING") || !summary.HasExtension("STARTTLS") {
+		t.Fatal("unexpected extensions:", summary.ehloExtensions)
+	}
+	if strings.Join(summary.authMechanisms, ",") != "PLAIN,LOGIN" {
+		t.Fatal("unexpected mechanisms:", summary.authMechanisms)
+	}
+
+	record := createTxtRecord("mx.example.test", []*MxHostSummary{summary})
+	if str := record.String(); !strings.Contains(str, "requiretls=yes") {
+		t.Fatal("unexpected TXT record:", str)
+	}
+
+	// The extra connection of the zgrab scanner uses the source address of the host check
+	target := server.Target("mx.example.test")
+	target.Source = net.ParseIP("127.0.0.1")
+	grab := &MxHostGrab{}
+	grab.fetchTlsEhlo(target, 2*time.Second, "localhost")
+	if grab.tlsEhlo == nil || !ehloHasExtension(*grab.tlsEhlo, "REQUIRETLS") {
+		t.Fatal("unexpected EHLO response:", grab.tlsEhlo)
+	}
+	if !grab.sourceAddress.Equal(target.Source) {
+		t.Fatal("unexpected source address:", grab.sourceAddress)
+	}
+}
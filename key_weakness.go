@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/zmap/zgrab/ztools/x509"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	minRSAExponent = 65537
+	minCurveBits   = 256
+)
+
+var (
+	// Small primes used for the ROCA fingerprint
+	rocaPrimes = []int64{3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131, 137, 139, 149, 151, 157, 163, 167}
+)
+
+// Detects a weakness of a public key
+type KeyWeakness interface {
+	Name() string
+	Weak(cert *x509.Certificate) bool
+}
+
+// Runs multiple detectors
+type KeyChecker struct {
+	detectors []KeyWeakness
+}
+
+// Adds a detector
+func (checker *KeyChecker) Add(detector KeyWeakness) {
+	checker.detectors = append(checker.detectors, detector)
+}
+
+// Returns the names of the detected weaknesses
+func (checker *KeyChecker) Check(cert *x509.Certificate) []string {
+	result := make([]string, 0)
+	for _, detector := range checker.detectors {
+		if detector.Weak(cert) {
+			result = append(result, detector.Name())
+		}
+	}
+	return result
+}
+
+// Detects RSA moduli generated by the vulnerable Infineon library (CVE-2017-15361)
+type RocaDetector struct {
+	// For each prime the residues generated by 65537
+	residues map[int64]map[int64]bool
+}
+
+func NewRocaDetector() *RocaDetector {
+	detector := &RocaDetector{
+		residues: make(map[int64]map[int64]bool),
+	}
+
+	for _, prime := range rocaPrimes {
+		set := make(map[int64]bool)
+		value := int64(1)
+		for !set[value] {
+			set[value] = true
+			value = (value * 65537) % prime
+		}
+		detector.residues[prime] = set
+	}
+
+	return detector
+}
+
+func (detector *RocaDetector) Name() string {
+	return "roca"
+}
+
+func (detector *RocaDetector) Weak(cert *x509.Certificate) bool {
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return false
+	}
+
+	modulus := new(big.Int)
+	for _, prime := range rocaPrimes {
+		modulus.Mod(key.N, big.NewInt(prime))
+		if !detector.residues[prime][modulus.Int64()] {
+			return false
+		}
+	}
+	return true
+}
+
+// Detects RSA keys with a small public exponent
+type SmallExponentDetector struct{}
+
+func (detector *SmallExponentDetector) Name() string {
+	return "small-exponent"
+}
+
+func (detector *SmallExponentDetector) Weak(cert *x509.Certificate) bool {
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	return ok && key.E < minRSAExponent
+}
+
+// Detects RSA moduli that are used in certificates with different subjects.
+// Keys of certificates saved by earlier runs are looked up in the database.
+type SharedModulusDetector struct {
+	subjects map[string]string // map from modulus hash to subject hash
+	sync.Mutex
+}
+
+func NewSharedModulusDetector() *SharedModulusDetector {
+	return &SharedModulusDetector{
+		subjects: make(map[string]string),
+	}
+}
+
+func (detector *SharedModulusDetector) Name() string {
+	return "shared-modulus"
+}
+
+func (detector *SharedModulusDetector) Weak(cert *x509.Certificate) bool {
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return false
+	}
+
+	modulus := sha1.Sum(key.N.Bytes())
+	subject := sha1.Sum(cert.RawSubject)
+
+	detector.Lock()
+	previous, exist := detector.subjects[string(modulus[:])]
+	if !exist {
+		detector.subjects[string(modulus[:])] = string(subject[:])
+	}
+	detector.Unlock()
+
+	if exist {
+		return previous != string(subject[:])
+	}
+	return dbconn != nil && keyHasOtherSubject(cert)
+}
+
+// Detects EC keys on curves with less than minCurveBits
+type WeakCurveDetector struct{}
+
+func (detector *WeakCurveDetector) Name() string {
+	return "weak-curve"
+}
+
+func (detector *WeakCurveDetector) Weak(cert *x509.Certificate) bool {
+	key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	return ok && key.Curve.Params().BitSize < minCurveBits
+}
+
+// Detects keys by the SHA256 hash of their SubjectPublicKeyInfo
+type CompromisedKeys struct {
+	hashes map[string]bool
+}
+
+// Reads hex encoded SHA256 hashes from a file, one per line
+func NewCompromisedKeys(path string) (*CompromisedKeys, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := &CompromisedKeys{
+		hashes: make(map[string]bool),
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+		keys.hashes[string(hash)] = true
+	}
+
+	return keys, scanner.Err()
+}
+
+func (keys *CompromisedKeys) Name() string {
+	return "compromised"
+}
+
+func (keys *CompromisedKeys) Weak(cert *x509.Certificate) bool {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return keys.hashes[string(hash[:])]
+}
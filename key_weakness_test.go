@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rsa"
+	"github.com/zmap/zgrab/ztools/x509"
+	"math/big"
+	"testing"
+)
+
+func TestRocaDetector(t *testing.T) {
+	detector := NewRocaDetector()
+
+	// Build a modulus that is a power of 65537 modulo all primes
+	primorial := big.NewInt(1)
+	for _, prime := range rocaPrimes {
+		primorial.Mul(primorial, big.NewInt(prime))
+	}
+	modulus := new(big.Int).Exp(big.NewInt(65537), big.NewInt(12345), primorial)
+	modulus.Add(modulus, new(big.Int).Mul(primorial, big.NewInt(7)))
+
+	cert := &x509.Certificate{PublicKey: &rsa.PublicKey{N: modulus, E: 65537}}
+	if !detector.Weak(cert) {
+		t.Fatal("fingerprint not detected")
+	}
+
+	cert = parseCertificate("testdata/example.com.crt")
+	if detector.Weak(cert) {
+		t.Fatal("false positive")
+	}
+}
+
+func TestSmallExponentDetector(t *testing.T) {
+	detector := &SmallExponentDetector{}
+
+	if !detector.Weak(&x509.Certificate{PublicKey: &rsa.PublicKey{N: big.NewInt(15), E: 3}}) {
+		t.Fatal("small exponent not detected")
+	}
+	if detector.Weak(&x509.Certificate{PublicKey: &rsa.PublicKey{N: big.NewInt(15), E: 65537}}) {
+		t.Fatal("false positive")
+	}
+}
+
+func TestSharedModulusDetector(t *testing.T) {
+	detector := NewSharedModulusDetector()
+	key := &rsa.PublicKey{N: big.NewInt(15), E: 65537}
+
+	certA := &x509.Certificate{PublicKey: key, RawSubject: []byte("a")}
+	certB := &x509.Certificate{PublicKey: key, RawSubject: []byte("b")}
+
+	if detector.Weak(certA) || detector.Weak(certA) {
+		t.Fatal("false positive")
+	}
+	if !detector.Weak(certB) {
+		t.Fatal("shared modulus not detected")
+	}
+}
+
+func TestKeyChecker(t *testing.T) {
+	checker := &KeyChecker{}
+	checker.Add(&SmallExponentDetector{})
+	checker.Add(&WeakCurveDetector{})
+
+	weaknesses := checker.Check(&x509.Certificate{PublicKey: &rsa.PublicKey{N: big.NewInt(15), E: 3}})
+	if len(weaknesses) != 1 || weaknesses[0] != "small-exponent" {
+		t.Fatal("unexpected value:", weaknesses)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/zmap/zgrab/zlib"
 	"github.com/zmap/zgrab/ztools/zlog"
+	"github.com/zmap/zgrab/ztools/ztls"
 	"log"
 	"os"
 	"os/signal"
@@ -31,12 +32,26 @@ var (
 	unboundTaFile           = "/etc/unbound/root.key"
 
 	// host settings
-	hostCacheEnable   bool
-	hostCacheExpires  uint = 3600
-	hostCacheRefresh  uint = 0
-	hostCacheInterval uint = 60
-	hostWorkers       uint = 500
-	hostTimeout       uint = 15
+	hostCacheEnable        bool
+	hostCacheExpires       uint    = 3600
+	hostCacheRefresh       uint    = 0
+	hostCacheInterval      uint    = 60
+	hostUnreachableRefresh uint    = 600   // transient errors
+	hostFailedRefresh      uint    = 86400 // permanent errors
+	hostFailedExpires      uint    = 86400 * 7
+	hostWorkers            uint    = 500
+	hostTimeout            uint    = 15
+	hostScanner            Scanner = &ZgrabScanner{}
+	enumerateCiphers       bool
+	probeVulnerabilities   bool
+	hostLimiter            *HostLimiter      // politeness limits per network and provider
+	hostRetries            uint         = 2  // attempts after transient errors
+	hostRetryDelay         uint         = 30 // seconds before the first retry
+	txtRequireTLS          bool              // publish requiretls=yes if all hosts announce REQUIRETLS
+	hostPorts              = []uint16{portSMTP}
+	sourcePool             *SourcePool // source addresses for host checks
+	addressFamily          = familyBoth
+	probeVersions          = []uint16{versionTLS13, ztls.VersionTLS12, ztls.VersionTLS11, ztls.VersionTLS10, ztls.VersionSSL30}
 
 	// mx cache
 	mxCacheEnable   bool
@@ -49,7 +64,15 @@ var (
 	dbUser string
 	dbHost = "/var/run/postgresql"
 
-	opensslBlacklist *OpensslBlacklist
+	opensslBlacklist    *OpensslBlacklist
+	opensslBlacklistDir = "/usr/share/openssl-blacklist"
+	keyChecker          *KeyChecker // detects weak public keys
+	ctLogs              *CtLogList  // known Certificate Transparency logs
+	validationTime      time.Time   // reference time for the revalidate command
+	aiaFetcher          *AiaFetcher // fetches missing intermediate certificates
+	aiaCacheDir         string
+	aiaTimeout          uint              = 10
+	mtaFingerprinter    *MtaFingerprinter // identifies the MTA software
 
 	dnsProcessor    *DnsProcessor    // dns lookups
 	hostProcessor   *HostProcessor   // host checks
@@ -79,7 +102,19 @@ func main() {
 	var command string
 	var singleWorker bool
 	var useOpensslBlacklist bool
+	var useWeakKeys bool
+	var compromisedKeys string
 	var dnsServerAddr string
+	var ctLogList string
+	var validationTimeStr string
+	var aiaFetch bool
+	var scannerName string
+	var tlsVersions string
+	var hostPortsStr string
+	var mtaRules string
+	var sourceAddresses string
+	var archiveDir string
+	var networkActive, networkRate, providerActive, providerRate uint
 
 	flags := flag.NewFlagSet("default", flag.ContinueOnError)
 
@@ -101,8 +136,15 @@ func main() {
 	flags.UintVar(&hostCacheExpires, "hostCacheExpires", hostCacheExpires, "A host result will be removed after this number of seconds not accessed. A value of 0 disables the cache.")
 	flags.UintVar(&hostCacheRefresh, "hostCacheRefresh", hostCacheRefresh, "A host result will be refreshed after this number of seconds. A value of 0 means it will never be refreshed.")
 	flags.UintVar(&hostCacheInterval, "hostCacheInterval", hostCacheInterval, "The cache worker will sleep for this duration of seconds between runs.")
+	flags.UintVar(&hostUnreachableRefresh, "hostUnreachableRefresh", hostUnreachableRefresh, "A host result with a transient error like a timeout will be refreshed after this number of seconds. A value of 0 means it will never be refreshed.")
+	flags.UintVar(&hostFailedRefresh, "hostFailedRefresh", hostFailedRefresh, "A host result with a permanent error like a refused connection will be refreshed after this number of seconds. A value of 0 means it will never be refreshed.")
+	flags.UintVar(&hostFailedExpires, "hostFailedExpires", hostFailedExpires, "A host result with a permanent error will be removed after this number of seconds not accessed.")
 
 	flags.BoolVar(&useOpensslBlacklist, "opensslBlacklist", false, "Test public keys againts openssl blacklist")
+	flags.StringVar(&opensslBlacklistDir, "opensslBlacklistDir", opensslBlacklistDir, "Directory of the openssl blacklist files")
+	flags.BoolVar(&useWeakKeys, "weakKeys", false, "Test public keys for ROCA, small exponents, shared moduli and weak curves")
+	flags.StringVar(&compromisedKeys, "compromisedKeys", "", "Path to a file with hex encoded SHA256 hashes of compromised SubjectPublicKeyInfos")
+	flags.StringVar(&ctLogList, "ctLogList", "", "Path to a JSON list of Certificate Transparency logs. If omitted, SCTs will not be verified.")
 
 	// mx cache
 	flags.BoolVar(&mxCacheEnable, "mxCacheEnable", mxCacheEnable, "Always true if dnsServer is enabled or command is 'import-mx'")
@@ -115,12 +157,35 @@ func main() {
 	flags.UintVar(&mxWorkers, "mxWorkers", mxWorkers, "Number of mx workers")
 	flags.UintVar(&hostWorkers, "hostWorkers", hostWorkers, "Number of zgrab workers")
 	flags.UintVar(&hostTimeout, "hostTimeout", hostTimeout, "zgrab timeout in seconds")
+	flags.UintVar(&hostRetries, "hostRetries", hostRetries, "Number of retries after transient errors like timeouts or 4xx greetings")
+	flags.UintVar(&hostRetryDelay, "hostRetryDelay", hostRetryDelay, "Seconds before the first retry, doubled for each further retry")
+	flags.UintVar(&networkActive, "networkActive", 0, "Maximum number of concurrent host checks per IPv4 /24 or IPv6 /48. A value of 0 disables the limit.")
+	flags.UintVar(&networkRate, "networkRate", 0, "Maximum number of host checks per minute per IPv4 /24 or IPv6 /48. A value of 0 disables the limit.")
+	flags.UintVar(&providerActive, "providerActive", 0, "Maximum number of concurrent host checks per MX provider, the registered domain of the MX hostname. A value of 0 disables the limit.")
+	flags.UintVar(&providerRate, "providerRate", 0, "Maximum number of host checks per minute per MX provider. A value of 0 disables the limit.")
+	flags.StringVar(&tlsVersions, "tlsVersions", "ssl3,tls1.0,tls1.1,tls1.2,tls1.3", "TLS versions to probe. Versions not supported by the scanner backend are skipped.")
+	flags.BoolVar(&enumerateCiphers, "enumerateCiphers", enumerateCiphers, "Enumerate the accepted cipher suites and their order for each TLS version. Requires a connection per cipher suite.")
+	flags.BoolVar(&probeVulnerabilities, "probeVulnerabilities", probeVulnerabilities, "Probe for RC4 and export cipher suites and TLS_FALLBACK_SCSV support. Requires up to three additional connections per host.")
+	flags.BoolVar(&txtRequireTLS, "txtRequireTLS", txtRequireTLS, "Add 'requiretls=yes' to the TXT record if all hosts announce the REQUIRETLS extension")
+	flags.StringVar(&hostPortsStr, "hostPorts", "25", "Ports to check for each address. 465 uses implicit TLS, all others STARTTLS. The policy is only based on port 25.")
+	flags.StringVar(&mtaRules, "mtaRules", "", "Path to a file with rules for the MTA identification. Each line consists of the product, the source (banner or ehlo) and a regular expression. If omitted, built-in rules are used.")
+	flags.StringVar(&sourceAddresses, "sourceAddresses", "", "Comma separated IPv4 and IPv6 addresses to bind host checks to, one per host check and used round-robin per family. Requires the go scanner.")
+	flags.StringVar(&addressFamily, "addressFamily", addressFamily, "Address family of the host checks: 'ipv4', 'ipv6' or 'both'")
+	flags.StringVar(&scannerName, "scanner", "zgrab", "Scanner backend for host checks: 'zgrab' (up to TLS 1.2) or 'go' (up to TLS 1.3)")
 	flags.UintVar(&domainWorkers, "domainWorkers", domainWorkers, "Number of dns workers")
 	flags.UintVar(&resultWorkers, "resultWorkers", resultWorkers, "Number of result workers that store results in the database")
 	flags.UintVar(&unboundDebug, "unboundDebug", unboundDebug, "Debug level for libunbound")
 	flags.StringVar(&unboundTaFile, "unboundTaFile", unboundTaFile, "Trusted anchor file for libunbound")
 	flags.BoolVar(&singleWorker, "singleWorker", false, "Limit the number of workers per worker pool to one")
 
+	flags.BoolVar(&aiaFetch, "aiaFetch", false, "Fetch missing intermediate certificates from the Authority Information Access URL")
+	flags.StringVar(&aiaCacheDir, "aiaCacheDir", aiaCacheDir, "Directory for fetched intermediate certificates. If omitted, they are only cached in memory.")
+	flags.UintVar(&aiaTimeout, "aiaTimeout", aiaTimeout, "Timeout in seconds for fetching intermediate certificates")
+	flags.StringVar(&archiveDir, "archiveDir", "", "Directory for the compressed raw grabs of each host check, used by the reanalyze command. Requires the zgrab scanner. If omitted, nothing is archived.")
+	flags.StringVar(&zgrabFile, "zgrabFile", "", "Path to the zgrab output for import-zgrab, optionally gzip compressed. If omitted, it is read from the input of the command.")
+	flags.UintVar(&zgrabPort, "zgrabPort", zgrabPort, "Port that was scanned by zgrab. TXT records are only written for port 25.")
+	flags.StringVar(&validationTimeStr, "validationTime", "", "Reference time for the revalidate command in RFC 3339 format. Defaults to the current time.")
+
 	flags.StringVar(&dbName, "dbName", dbName, "Database name. If omitted, not data will be saved.")
 	flags.StringVar(&dbHost, "dbHost", dbHost, "Database host or path to unix socket")
 	flags.StringVar(&dbUser, "dbUser", dbUser, "Database user")
@@ -134,7 +199,12 @@ func main() {
 		fmt.Fprintln(os.Stderr, "\nActions:\n")
 		fmt.Fprintln(os.Stderr, "  import-domains: Read domains from stdin for MX lookups")
 		fmt.Fprintln(os.Stderr, "  import-addresses: Read ip addresses from stdin and run host checks. Cache will be disabled.")
+		fmt.Fprintln(os.Stderr, "  import-zgrab: Read zgrab JSON lines grouped by the domain from -zgrabFile or stdin and run the checks on -zgrabPort without connecting")
 		fmt.Fprintln(os.Stderr, "  resolve-mx: Read mx records from the domains table and resolve them to A/AAAA records")
+		fmt.Fprintln(os.Stderr, "  reanalyze: Rebuild the host results and TXT records from the latest transcripts in -archiveDir")
+		fmt.Fprintln(os.Stderr, "  revalidate: Rebuild the certificate chains of all mx_hosts at -validationTime and refresh the MX hostnames whose validity changed")
+		fmt.Fprintln(os.Stderr, "  dual-stack: List the MX hostnames whose IPv4 and IPv6 hosts differ")
+		fmt.Fprintln(os.Stderr, "  inconsistent: List the MX hostnames whose addresses differ the most")
 		// TODO document all commands
 		os.Exit(1)
 	}
@@ -142,8 +212,51 @@ func main() {
 		command = args[0]
 	}
 
+	// Configure weak key detection
+	checker := &KeyChecker{}
 	if useOpensslBlacklist {
-		opensslBlacklist = NewOpensslBlacklist()
+		opensslBlacklist = NewOpensslBlacklist(opensslBlacklistDir)
+		checker.Add(opensslBlacklist)
+	}
+	if useWeakKeys {
+		checker.Add(NewRocaDetector())
+		checker.Add(&SmallExponentDetector{})
+		checker.Add(NewSharedModulusDetector())
+		checker.Add(&WeakCurveDetector{})
+	}
+	if compromisedKeys != "" {
+		if keys, err := NewCompromisedKeys(compromisedKeys); err != nil {
+			log.Println("Unable to load compromised keys:", err)
+		} else {
+			checker.Add(keys)
+		}
+	}
+	if len(checker.detectors) > 0 {
+		keyChecker = checker
+	}
+
+	if ctLogList != "" {
+		if ctLogs, err = NewCtLogList(ctLogList); err != nil {
+			log.Fatalln("Unable to load CT log list:", err)
+		}
+	}
+
+	if mtaFingerprinter, err = NewMtaFingerprinter(mtaRules); err != nil {
+		log.Fatalln("Unable to load MTA rules:", err)
+	}
+
+	if archiveDir != "" {
+		transcriptArchive = NewTranscriptArchive(archiveDir)
+	}
+
+	if aiaFetch {
+		aiaFetcher = NewAiaFetcher(aiaCacheDir, time.Duration(aiaTimeout)*time.Second)
+	}
+
+	if validationTimeStr == "" {
+		validationTime = time.Now()
+	} else if validationTime, err = time.Parse(time.RFC3339, validationTimeStr); err != nil {
+		log.Fatalln("invalid validationTime:", err)
 	}
 
 	if hostTimeout == 0 {
@@ -152,6 +265,34 @@ func main() {
 	}
 	zlibConfig.Timeout = time.Duration(hostTimeout) * time.Second
 
+	if sourceAddresses != "" {
+		if sourcePool, err = NewSourcePool(sourceAddresses); err != nil {
+			log.Fatalln("invalid sourceAddresses:", err)
+		}
+	}
+	if addressTypes, err = familyAddressTypes(addressFamily); err != nil {
+		log.Fatalln(err)
+	}
+	if hostScanner, err = NewScanner(scannerName); err != nil {
+		log.Fatalln(err)
+	}
+	if _, ok := hostScanner.(*ZgrabScanner); transcriptArchive != nil && !ok {
+		log.Fatalln("archiveDir requires the zgrab scanner")
+	}
+	if probeVersions, err = parseTLSVersions(tlsVersions); err != nil {
+		log.Fatalln(err)
+	}
+	if hostPorts, err = parsePorts(hostPortsStr); err != nil {
+		log.Fatalln("invalid hostPorts:", err)
+	}
+	if zgrabPort == 0 || zgrabPort > 65535 {
+		log.Fatalln("invalid zgrabPort:", zgrabPort)
+	}
+
+	if networkActive > 0 || networkRate > 0 || providerActive > 0 || providerRate > 0 {
+		hostLimiter = NewHostLimiter(networkActive, networkRate, providerActive, providerRate)
+	}
+
 	if singleWorker {
 		dnsWorkers = 1
 		hostWorkers = 1
@@ -196,6 +337,8 @@ func main() {
 			log.Fatalln("hostCacheInterval must be > 0")
 		}
 		hostCache = NewCacheConfig(hostCacheExpires, hostCacheRefresh, hostCacheInterval)
+		hostCache.AddOutcome(outcomeUnreachable, hostCacheExpires, hostUnreachableRefresh)
+		hostCache.AddOutcome(outcomeFailed, hostFailedExpires, hostFailedRefresh)
 	}
 
 	if mxCacheEnable {
@@ -243,7 +386,7 @@ func main() {
 		log.Println("received", sig)
 	} else {
 		// Process Command
-		err = processCommand(args[0], bufio.NewScanner(os.Stdin), bufio.NewWriter(os.Stdout))
+		err = processCommand(args[0], os.Stdin, bufio.NewWriter(os.Stdout))
 	}
 
 	stopProcessors()
@@ -257,8 +400,8 @@ func main() {
 func stopProcessors() {
 	mxProcessor.Close()
 	domainProcessor.Close()
+	hostProcessor.Close() // uses the dnsProcessor for PTR lookups
 	dnsProcessor.Close()
-	hostProcessor.Close()
 
 	if resultProcessor != nil {
 		resultProcessor.Close()
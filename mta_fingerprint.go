@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Built-in rules, the first matching rule wins. Provider gateways must
+// precede the products they are based on.
+const defaultMtaRules = `
+# product        source  pattern (the first group is the version)
+microsoft-365    banner  (?i)\.outlook\.com
+google           banner  (?i)mx\.google\.com
+proofpoint       banner  (?i)pphosted\.com
+mimecast         banner  (?i)mimecast
+exchange         banner  (?i)Microsoft ESMTP MAIL Service(?:, Version: ([0-9][0-9.]*))?
+exchange         ehlo    (?i)^(?:XEXCH50|X-EXPS|X-ANONYMOUSTLS)\b
+postfix          banner  (?i)ESMTP Postfix(?: \(([0-9][0-9.]*)\))?
+exim             banner  (?i)ESMTP Exim ([0-9][0-9.]*)
+sendmail         banner  (?i)ESMTP Sendmail ([0-9][0-9.]*)
+opensmtpd        banner  (?i)ESMTP OpenSMTPD
+haraka           banner  (?i)ESMTP Haraka(?:/([0-9][0-9.]*))?
+`
+
+var mtaRuleLine = regexp.MustCompile(`^(\S+)\s+(banner|ehlo)\s+(.+)$`)
+
+// Identifies a MTA product by the banner or the EHLO response
+type MtaRule struct {
+	Product string
+	Source  string // "banner" or "ehlo"
+	Pattern *regexp.Regexp
+}
+
+type MtaFingerprinter struct {
+	rules []*MtaRule
+}
+
+// Loads the rules from a file or the built-in rules if the path is empty
+func NewMtaFingerprinter(path string) (*MtaFingerprinter, error) {
+	if path == "" {
+		return ParseMtaRules(strings.NewReader(defaultMtaRules))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseMtaRules(file)
+}
+
+// Parses rules in the format "product source pattern"
+func ParseMtaRules(reader io.Reader) (*MtaFingerprinter, error) {
+	fingerprinter := &MtaFingerprinter{}
+
+	scanner := bufio.NewScanner(reader)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		match := mtaRuleLine.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("invalid rule in line %d", lineNo)
+		}
+		pattern, err := regexp.Compile(match[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern in line %d: %s", lineNo, err)
+		}
+
+		fingerprinter.rules = append(fingerprinter.rules, &MtaRule{
+			Product: match[1],
+			Source:  match[2],
+			Pattern: pattern,
+		})
+	}
+
+	return fingerprinter, scanner.Err()
+}
+
+// Returns the product and the version if available.
+// EHLO rules are matched against each extension line.
+func (fingerprinter *MtaFingerprinter) Identify(banner string, ehlo string) (product string, version string) {
+	ehloLines := strings.Split(strings.Replace(ehlo, "\r\n", "\n", -1), "\n")
+	for i, line := range ehloLines {
+		if len(line) >= 4 && (line[3] == '-' || line[3] == ' ') {
+			ehloLines[i] = line[4:]
+		}
+	}
+
+	for _, rule := range fingerprinter.rules {
+		var match []string
+
+		switch rule.Source {
+		case "banner":
+			match = rule.Pattern.FindStringSubmatch(banner)
+		case "ehlo":
+			for _, line := range ehloLines {
+				if match = rule.Pattern.FindStringSubmatch(line); match != nil {
+					break
+				}
+			}
+		}
+
+		if match != nil {
+			product = rule.Product
+			if len(match) > 1 {
+				version = match[1]
+			}
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMtaFingerprinterDefaults(t *testing.T) {
+	fingerprinter, err := NewMtaFingerprinter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		banner  string
+		ehlo    string
+		product string
+		version string
+	}{
+		{"220 mail.example.com ESMTP Exim 4.92 Mon, 01 Jan 2018 00:00:00 +0000", "", "exim", "4.92"},
+		{"220 mail.example.com ESMTP Postfix (Debian/GNU)", "", "postfix", ""},
+		{"220 mx.google.com ESMTP a1si123456", "", "google", ""},
+		{"220 EUR01-VE1-obe.outbound.protection.outlook.com Microsoft ESMTP MAIL Service ready", "", "microsoft-365", ""},
+		{"220 mail.example.com", "250-mail.example.com\r\n250-SIZE\r\n250 XEXCH50", "exchange", ""},
+		{"220 mail.example.com", "250-mail.example.com\r\n250 SIZE", "", ""},
+	}
+
+	for _, test := range tests {
+		product, version := fingerprinter.Identify(test.banner, test.ehlo)
+		if product != test.product || version != test.version {
+			t.Errorf("%q: got %q %q", test.banner, product, version)
+		}
+	}
+}
+
+func TestParseMtaRulesInvalid(t *testing.T) {
+	if _, err := ParseMtaRules(strings.NewReader("postfix header Postfix")); err == nil {
+		t.Fatal("error expected for an unknown source")
+	}
+	if _, err := ParseMtaRules(strings.NewReader("postfix banner (")); err == nil {
+		t.Fatal("error expected for an invalid pattern")
+	}
+}
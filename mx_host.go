@@ -1,30 +1,54 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"github.com/deckarep/golang-set"
 	"github.com/zmap/zgrab/zlib"
 	"github.com/zmap/zgrab/ztools/x509"
 	"github.com/zmap/zgrab/ztools/ztls"
 	"net"
+	"sort"
 	"strings"
 	"time"
 )
 
 // Summarizes the results of multiple connections to a single host
 type MxHostSummary struct {
-	address         net.IP    `json:"-"`
+	address         net.IP `json:"-"`
+	port            uint16
+	serverName      string    // sent via SNI
+	ptrNames        []string  // results of the reverse lookup
+	sourceAddress   net.IP    // local address of the connections
 	Updated         time.Time `json:"updated"`
 	Starttls        *bool     `json:"starttls"`
 	tlsVersions     mapset.Set
 	tlsCipherSuites mapset.Set
 	certificates    []*x509.Certificate
+	scts            [][]byte // SCTs from the TLS extension
 	fingerprints    [][]byte
 	validity        *CertificateValidity
 	ecdheCurveType  *byte
 	ecdheCurveId    *ztls.CurveID
 	ecdheKeyLength  *int
-	Error           *string `json:"error"` // only the first error
+	dhPrimeBits     *int                // the smallest finite-field DH prime
+	dhPrimeCommon   *string             // name of a common prime
+	forwardSecrecy  *bool               // true if all handshakes used an ephemeral key exchange
+	sniCertDiffers  *bool               // certificate without SNI differs
+	acceptedCiphers map[uint16][]uint16 // cipher suites per TLS version accepted during the enumeration
+	cipherOrder     map[uint16][]uint16 // the server's order of preference, if it enforces one and the scanner can tell
+	banner          *string             // SMTP greeting
+	ehloExtensions  []string            // extension keywords announced in the EHLO response
+	authMechanisms  []string            // SASL mechanisms announced in the EHLO response
+	mtaProduct      *string             // identified by the banner and EHLO response
+	mtaVersion      *string
+	vulnerabilities *TlsVulnerabilities
+	partial         bool         // created from stored grabs, without the other connections of a host check
+	transcripts     []*zlib.Grab // raw logs of the first grab and the version probes
+	transcript      *string      // hash of the archived transcript
+	Error           *string      `json:"error"` // only the first error
+	ErrorClass      *string      `json:"error_class"`
 }
 
 // The result of a single connection attempt using zlib.Grab
@@ -33,56 +57,287 @@ type MxHostGrab struct {
 	tlsVersion     ztls.TLSVersion
 	tlsCipherSuite ztls.CipherSuite
 	certificates   []*x509.Certificate
+	scts           [][]byte
 	dhParams       interface{}
-	Error          *string
+	banner         *string
+	ehlo           *string // the EHLO response before STARTTLS
+	tlsEhlo        *string // the EHLO response over TLS
+
+	// Flags of the ServerHello and the handshake, nil if unknown
+	compression         *bool
+	secureRenegotiation *bool
+	heartbeat           *bool
+	clientCertRequested *bool
+
+	sourceAddress net.IP     // local address, nil if unknown
+	transcript    *zlib.Grab // raw log, nil for the go scanner
+
+	Error      *string
+	errorClass *string
 }
 
 // Summry of multiple connection attemps to a single host
-func NewMxHostSummary(address net.IP) *MxHostSummary {
-	result := &MxHostSummary{
-		address: address,
-		Updated: time.Now().UTC(),
+func NewMxHostSummary(target *ScanTarget) *MxHostSummary {
+	result := newMxHostSummary(target, time.Now())
+
+	versions := scannerProbeVersions(hostScanner, probeVersions)
+	if len(versions) == 0 {
+		err := "no TLS version to probe"
+		class := errorOther
+		result.Error = &err
+		result.ErrorClass = &class
+		return result
 	}
 
-	// The first connection attempt with up to TLS 1.2
-	grab := NewMxHostGrab(address, ztls.VersionTLS12)
+	// All connections of the host check use the same source address
+	if sourcePool != nil && target.Source == nil {
+		bound := *target
+		bound.Source = sourcePool.Next(target.Address)
+		target = &bound
+	}
 
-	result.Starttls = grab.starttls
-	result.Error = grab.Error
+	// The first connection attempt with the highest version.
+	// Like the probes below, the connection for the EHLO response over TLS
+	// belongs to the host check admitted by the limiter and uses its source address.
+	grab := hostScanner.Grab(target, versions[0], nil)
+	if _, ok := hostScanner.(*ZgrabScanner); ok && grab.TLSSuccessful() && grab.tlsEhlo == nil {
+		grab.fetchTlsEhlo(target, zlibConfig.Timeout, zlibConfig.EHLODomain)
+	}
+	result.setFirstGrab(grab)
 
 	// Was the TLS handshake successful?
 	if result.Starttls != nil && *result.Starttls {
 		result.Append(grab)
+		first := grab
+
+		// Probe the remaining versions that have not been negotiated yet
+		for _, version := range versions[1:] {
+			if result.HasTLSVersion(version) {
+				continue
+			}
+			if grab = hostScanner.Grab(target, version, nil); grab.TLSSuccessful() {
+				result.Append(grab)
+				result.addTranscript(grab)
+			}
+		}
+
+		// Enumerate the cipher suites of each negotiated version
+		if enumerateCiphers {
+			result.enumerateCipherSuites(target, versions)
+		}
+
+		// Compression, renegotiation, fallback and weak suites
+		if first.TLSSuccessful() {
+			result.probeVulnerabilities(target, first, versions)
+		}
 
-		// Try TLS 1.0 as well if we just had a higher version
-		if grab.tlsVersion > ztls.VersionTLS10 {
-			if grab = NewMxHostGrab(address, ztls.VersionTLS10); grab.TLSSuccessful() {
+		// Compare with the certificate presented without SNI
+		if target.ServerName != "" && result.certificates != nil {
+			plain := *target
+			plain.ServerName = ""
+			if grab = hostScanner.Grab(&plain, versions[0], nil); grab.TLSSuccessful() {
+				differs := !bytes.Equal(grab.certificates[0].Raw, result.certificates[0].Raw)
+				result.sniCertDiffers = &differs
+			}
+		}
+	}
+
+	result.validate()
+	return result
+}
+
+// Creates a summary from existing grabs without further connections.
+// The first grab is the initial connection, the others are version probes.
+func NewMxHostSummaryFromGrabs(target *ScanTarget, grabs []*MxHostGrab, updated time.Time) *MxHostSummary {
+	result := newMxHostSummary(target, updated)
+	result.partial = true
+	first := grabs[0]
+	result.setFirstGrab(first)
+
+	if result.Starttls != nil && *result.Starttls {
+		result.Append(first)
+		for _, grab := range grabs[1:] {
+			if grab.TLSSuccessful() {
 				result.Append(grab)
+				result.addTranscript(grab)
 			}
 		}
+		if first.TLSSuccessful() {
+			result.vulnerabilities = passiveVulnerabilities(first)
+		}
+	}
+
+	result.validate()
+	return result
+}
+
+func newMxHostSummary(target *ScanTarget, updated time.Time) *MxHostSummary {
+	return &MxHostSummary{
+		address:    target.Address,
+		port:       target.Port,
+		serverName: target.ServerName,
+		Updated:    updated.UTC(),
+	}
+}
+
+// Copies the connection results of the first grab
+func (summary *MxHostSummary) setFirstGrab(grab *MxHostGrab) {
+	summary.Starttls = grab.starttls
+	summary.Error = grab.Error
+	summary.ErrorClass = grab.errorClass
+	summary.sourceAddress = grab.sourceAddress
+	summary.banner = grab.banner
+	summary.setEhloExtensions(grab)
+	summary.identifyMta(grab)
+	summary.addTranscript(grab)
+}
+
+// The extensions are taken from the EHLO response over TLS. The response
+// before STARTTLS only counts for STARTTLS itself or if TLS has failed.
+func (summary *MxHostSummary) setEhloExtensions(grab *MxHostGrab) {
+	summary.ehloExtensions, summary.authMechanisms = nil, nil
+
+	if !grab.TLSSuccessful() {
+		if grab.ehlo != nil {
+			summary.ehloExtensions, summary.authMechanisms = parseEhloResponse(*grab.ehlo)
+		}
+		return
+	}
+
+	if grab.tlsEhlo != nil {
+		summary.ehloExtensions, summary.authMechanisms = parseEhloResponse(*grab.tlsEhlo)
+	}
+	if grab.ehlo != nil && ehloHasExtension(*grab.ehlo, "STARTTLS") && !containsString(summary.ehloExtensions, "STARTTLS") {
+		summary.ehloExtensions = append(summary.ehloExtensions, "STARTTLS")
+	}
+}
+
+func (summary *MxHostSummary) addTranscript(grab *MxHostGrab) {
+	if grab.transcript != nil {
+		summary.transcripts = append(summary.transcripts, grab.transcript)
+	}
+}
+
+// Sets the fingerprints and the certificate validity
+func (summary *MxHostSummary) validate() {
+	if summary.certificates != nil {
+		summary.fingerprints = summary.Fingerprints()
+		summary.validity = NewCertificateValidity(summary.certificates, summary.scts)
+	}
+}
+
+// Identifies the MTA software by the banner and the EHLO response
+func (summary *MxHostSummary) identifyMta(grab *MxHostGrab) {
+	if mtaFingerprinter == nil || (grab.banner == nil && grab.ehlo == nil && grab.tlsEhlo == nil) {
+		return
+	}
+
+	var banner, ehlo string
+	if grab.banner != nil {
+		banner = *grab.banner
+	}
+	if grab.ehlo != nil {
+		ehlo = *grab.ehlo
+	} else if grab.tlsEhlo != nil {
+		// implicit TLS
+		ehlo = *grab.tlsEhlo
+	}
+
+	product, version := mtaFingerprinter.Identify(banner, ehlo)
+	if product != "" {
+		summary.mtaProduct = &product
+	}
+	if version != "" {
+		summary.mtaVersion = &version
+	}
+}
+
+// Enumerates the cipher suites of the negotiated versions
+func (summary *MxHostSummary) enumerateCipherSuites(target *ScanTarget, versions []uint16) {
+	summary.acceptedCiphers = make(map[uint16][]uint16)
+	summary.cipherOrder = make(map[uint16][]uint16)
+
+	for _, version := range versions {
+		// TLS 1.3 suites can not be restricted
+		if version >= versionTLS13 || !summary.HasTLSVersion(version) {
+			continue
+		}
+
+		suites := enumerateCipherSuites(hostScanner, target, version)
+		summary.acceptedCiphers[version] = suites
+
+		// The suites are in the order of the offer if the server follows the client
+		if hostScanner.KeepsCipherOrder() && hasServerCipherOrder(hostScanner, target, version, suites) {
+			summary.cipherOrder[version] = suites
+		}
+	}
+}
+
+// The cipher suites accepted during the enumeration of any TLS version
+func (summary *MxHostSummary) AcceptedCipherSuites() [][]byte {
+	unique := make(map[uint16]bool)
+	for _, suites := range summary.acceptedCiphers {
+		for _, suite := range suites {
+			unique[suite] = true
+		}
 	}
 
-	// set fingerprints and certificate validity
-	if result.certificates != nil {
-		result.fingerprints = result.Fingerprints()
-		result.validity = NewCertificateValidity(result.certificates)
+	result := make([][]byte, 0, len(unique))
+	for suite := range unique {
+		result = append(result, ztls.CipherSuite(suite).Bytes())
 	}
+	return result
+}
 
+// The cipher order as strings like "0303:c02f,c030"
+func (summary *MxHostSummary) CipherOrderStrings() []string {
+	result := make([]string, 0, len(summary.cipherOrder))
+	for version, suites := range summary.cipherOrder {
+		hexSuites := make([]string, len(suites))
+		for i, suite := range suites {
+			hexSuites[i] = hex.EncodeToString(ztls.CipherSuite(suite).Bytes())
+		}
+		result = append(result, hex.EncodeToString(ztls.TLSVersion(version).Bytes())+":"+strings.Join(hexSuites, ","))
+	}
+	sort.Strings(result)
 	return result
 }
 
+// Has the host negotiated or accepted a weak cipher suite?
+func (summary *MxHostSummary) HasWeakCipherSuite() bool {
+	for _, suite := range summary.AcceptedCipherSuites() {
+		if isWeakCipherSuite(uint16(suite[0])<<8 | uint16(suite[1])) {
+			return true
+		}
+	}
+	if summary.tlsCipherSuites == nil {
+		return false
+	}
+	for item := range summary.tlsCipherSuites.Iter() {
+		suite := item.(string)
+		if isWeakCipherSuite(uint16(suite[0])<<8 | uint16(suite[1])) {
+			return true
+		}
+	}
+	return false
+}
+
 // Result of a single connection attempt with ZGrab
 func NewMxHostGrab(address net.IP, tlsVersion uint16) *MxHostGrab {
-	result := &MxHostGrab{}
-	var tlsHandshake *ztls.ServerHandshake
-	var tlsHello *ztls.ServerHello
+	return (&ZgrabScanner{}).Grab(&ScanTarget{Address: address, Port: portSMTP}, tlsVersion, nil)
+}
 
-	// Create a local copy of the default config
-	config := *zlibConfig
-	config.TLSVersion = tlsVersion // maximum TLS version
+// Result of a single connection attempt with the given ZGrab config
+func grabWithConfig(config *zlib.Config, target *ScanTarget) *MxHostGrab {
+	// Grab the banner, the domain is used for SNI
+	return newMxHostGrabFromBanner(zlib.GrabBanner(config, &zlib.GrabTarget{Addr: target.Address, Domain: target.ServerName}))
+}
 
-	// Grab the banner
-	banner := zlib.GrabBanner(&config, &zlib.GrabTarget{Addr: address})
+// Extracts the results from the log of a banner grab
+func newMxHostGrabFromBanner(banner *zlib.Grab) *MxHostGrab {
+	result := &MxHostGrab{transcript: banner}
+	var tlsHandshake *ztls.ServerHandshake
+	var tlsHello *ztls.ServerHello
 
 	// Loop trough the banner log
 	for _, entry := range banner.Log {
@@ -92,15 +347,33 @@ func NewMxHostGrab(address net.IP, tlsVersion uint16) *MxHostGrab {
 		case *zlib.TLSHandshakeEvent:
 			tlsHandshake = data.GetHandshakeLog()
 			tlsHello = tlsHandshake.ServerHello
+
+			// Implicit TLS has no STARTTLS event
+			if result.starttls == nil {
+				val := entry.Error == nil
+				result.starttls = &val
+			}
 		case *zlib.StartTLSEvent:
 			val := entry.Error == nil
 			result.starttls = &val
+		case *zlib.MailBannerEvent:
+			if data.Banner != "" {
+				result.banner = &data.Banner
+			}
+		case *zlib.EHLOEvent:
+			if data.Response != "" && tlsHandshake != nil {
+				result.tlsEhlo = &data.Response
+			} else if data.Response != "" {
+				result.ehlo = &data.Response
+			}
 		}
 
 		if entry.Error != nil {
 			// If an error occurs we expect the log entry to be the last
 			err := simplifyError(entry.Error).Error()
+			class := classifyGrabError(data, entry.Error)
 			result.Error = &err
+			result.errorClass = &class
 		}
 	}
 
@@ -108,16 +381,29 @@ func NewMxHostGrab(address net.IP, tlsVersion uint16) *MxHostGrab {
 	if tlsHello != nil {
 		result.tlsVersion = tlsHello.Version
 		result.tlsCipherSuite = tlsHello.CipherSuite
+		result.setHelloFlags(tlsHello)
 	}
 
 	if tlsHandshake != nil {
 		// Certificates available?
 		if certs := tlsHandshake.ServerCertificates; certs != nil {
 			result.certificates = certs.ParsedCertificates
+
+			// Received but not parsed?
+			if len(certs.Certificates) > 0 && len(certs.ParsedCertificates) == 0 && result.Error == nil {
+				err := "unable to parse certificate"
+				class := errorCertificateParse
+				result.Error = &err
+				result.errorClass = &class
+			}
 		}
 
 		// Copy Diffie Hellman parameters
 		result.dhParams = tlsHandshake.DHParams
+
+		// ztls does not offer the signed_certificate_timestamp extension,
+		// so only SCTs embedded in the certificate can be verified.
+		// The GoScanner provides them.
 	}
 
 	return result
@@ -159,6 +445,7 @@ func (summary *MxHostSummary) Append(grab *MxHostGrab) {
 	// Copy certificates
 	if summary.certificates == nil {
 		summary.certificates = grab.certificates
+		summary.scts = grab.scts
 	}
 
 	if grab.tlsVersion != 0 {
@@ -170,17 +457,65 @@ func (summary *MxHostSummary) Append(grab *MxHostGrab) {
 		summary.tlsVersions.Add(string(grab.tlsVersion.Bytes()))
 		summary.tlsCipherSuites.Add(string(grab.tlsCipherSuite.Bytes()))
 
-		// Copy ECDHE params
-		if summary.ecdheCurveType == nil {
-			if ecdheParams, ok := grab.dhParams.(*ztls.ECDHEParams); ok {
-				summary.ecdheCurveType = &ecdheParams.CurveType
-				summary.ecdheCurveId = &ecdheParams.CurveID
-				summary.ecdheKeyLength = &ecdheParams.PublicKeyLength
+		forwardSecret := isForwardSecret(uint16(grab.tlsVersion), uint16(grab.tlsCipherSuite))
+		if summary.forwardSecrecy == nil || !forwardSecret {
+			summary.forwardSecrecy = &forwardSecret
+		}
+
+		switch params := grab.dhParams.(type) {
+		case *ztls.ECDHEParams:
+			// Copy ECDHE params
+			if summary.ecdheCurveType == nil {
+				summary.ecdheCurveType = &params.CurveType
+				summary.ecdheCurveId = &params.CurveID
+				if params.PublicKeyLength > 0 {
+					summary.ecdheKeyLength = &params.PublicKeyLength
+				}
+			}
+		case *ztls.DHParams:
+			// Keep the smallest prime
+			if params.Prime != nil {
+				bits := params.Prime.BitLen()
+				if summary.dhPrimeBits == nil || bits < *summary.dhPrimeBits {
+					summary.dhPrimeBits = &bits
+					summary.dhPrimeCommon = nil
+					if name := commonDhPrimeName(params.Prime); name != "" {
+						summary.dhPrimeCommon = &name
+					}
+				}
 			}
 		}
 	}
 }
 
+// Has the host used a small DH prime or a weak curve?
+func (summary *MxHostSummary) HasWeakDH() bool {
+	if summary.dhPrimeBits != nil && *summary.dhPrimeBits < minDhPrimeBits {
+		return true
+	}
+	return summary.ecdheCurveId != nil && weakCurves[uint16(*summary.ecdheCurveId)]
+}
+
+// Has the check failed with an error that might disappear on the next attempt?
+func (summary *MxHostSummary) IsTransientError() bool {
+	return summary.ErrorClass != nil && transientErrorClasses[*summary.ErrorClass]
+}
+
+// Has the check failed with an error that is unlikely to disappear soon?
+func (summary *MxHostSummary) IsPermanentError() bool {
+	return summary.ErrorClass != nil && permanentErrorClasses[*summary.ErrorClass]
+}
+
+// Has the extension been announced in the EHLO response?
+func (summary *MxHostSummary) HasExtension(keyword string) bool {
+	return containsString(summary.ehloExtensions, strings.ToUpper(keyword))
+}
+
+// Has the TLS version been negotiated?
+func (summary *MxHostSummary) HasTLSVersion(version uint16) bool {
+	return summary.tlsVersions != nil && summary.tlsVersions.Contains(string(ztls.TLSVersion(version).Bytes()))
+}
+
 // Checks if the certificate is valid for a given domain name
 func (summary *MxHostSummary) CertificateValidForDomain(domain string) bool {
 	return summary.certificates[0].VerifyHostname(domain) == nil
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"github.com/zmap/zgrab/ztools/ztls"
 	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSimplifyTimeoutError(t *testing.T) {
@@ -26,12 +28,42 @@ func TestSimplifyStarttlsError(t *testing.T) {
 }
 
 func TestTimeout(t *testing.T) {
-	address := net.ParseIP("192.168.254.254")
-	result := NewMxHostGrab(address, ztls.VersionTLS12)
+	// The server never sends a greeting
+	server := &fakeSmtpServer{}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+
+	defer func(timeout time.Duration) { zlibConfig.Timeout = timeout }(zlibConfig.Timeout)
+	zlibConfig.Timeout = 100 * time.Millisecond
+	result := (&ZgrabScanner{}).Grab(server.Target(""), ztls.VersionTLS12, nil)
+
+	if result.Error == nil || *result.Error != "i/o timeout" {
+		t.Fatal("an unexpected error occured:", result.Error)
+	}
+	if *result.errorClass != errorBannerTimeout {
+		t.Fatal("unexpected error class:", *result.errorClass)
+	}
+
+	if result.starttls != nil {
+		t.Fatal("host should not have starttls")
+	}
+}
 
-	if *result.Error != "i/o timeout" {
+func TestGoScannerTimeout(t *testing.T) {
+	// The server never sends a greeting
+	server := &fakeSmtpServer{}
+	server.Start(t, "127.0.0.1")
+	defer server.Close()
+
+	scanner := &GoScanner{Timeout: 100 * time.Millisecond, EHLODomain: "localhost"}
+	result := scanner.Grab(server.Target(""), ztls.VersionTLS12, nil)
+
+	if result.Error == nil || !strings.HasSuffix(*result.Error, "i/o timeout") {
 		t.Fatal("an unexpected error occured:", result.Error)
 	}
+	if *result.errorClass != errorBannerTimeout {
+		t.Fatal("unexpected error class:", *result.errorClass)
+	}
 
 	if result.starttls != nil {
 		t.Fatal("host should not have starttls")
@@ -1,30 +1,88 @@
 package main
 
 import (
+	"github.com/deckarep/golang-set"
 	"github.com/miekg/dns"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
 var (
-	addressTypes = []dns.Type{TypeA, dns.Type(TypeAAAA)}
+	addressTypes = []dns.Type{TypeA, dns.Type(TypeAAAA)} // set by -addressFamily
 )
 
 type MxProcessor struct {
 	cache *CachedWorkerPool
+
+	// map from MX hostname to the recipient domains
+	domains      map[string]mapset.Set
+	domainsMutex sync.Mutex
+
+	// map from MX hostname to inconsistent IPv4 and IPv6 hosts
+	dualStack      map[string]*DualStackReport
+	dualStackMutex sync.Mutex
+
+	// map from MX hostname to inconsistent addresses
+	consistency      map[string]*ConsistencyReport
+	consistencyMutex sync.Mutex
 }
 
 func NewMxProcessor(workersCount uint, cacheConfig *CacheConfig) *MxProcessor {
-	proc := &MxProcessor{}
+	proc := &MxProcessor{
+		domains:     make(map[string]mapset.Set),
+		dualStack:   make(map[string]*DualStackReport),
+		consistency: make(map[string]*ConsistencyReport),
+	}
 	proc.cache = NewCachedWorkerPool(workersCount, proc.work, cacheConfig)
+	proc.cache.expired = proc.forget
 	return proc
 }
 
+// Removes the recipient domains and reports of an expired MX hostname
+func (proc *MxProcessor) forget(hostname string) {
+	proc.domainsMutex.Lock()
+	delete(proc.domains, hostname)
+	proc.domainsMutex.Unlock()
+
+	proc.setDualStackReport(hostname, nil)
+	proc.setConsistencyReport(hostname, nil)
+}
+
 func (proc *MxProcessor) NewJob(hostname string) *CacheEntry {
 	return proc.cache.NewJob(hostname, time.Now())
 }
 
+// Runs the checks and the policy of a MX hostname again
+func (proc *MxProcessor) Refresh(hostname string) *CacheEntry {
+	return proc.cache.Refresh(hostname)
+}
+
+// Adds a recipient domain that points to the MX hostname
+func (proc *MxProcessor) AddDomain(hostname string, domain string) {
+	proc.domainsMutex.Lock()
+	defer proc.domainsMutex.Unlock()
+
+	set, ok := proc.domains[hostname]
+	if !ok {
+		set = mapset.NewThreadUnsafeSet()
+		proc.domains[hostname] = set
+	}
+	set.Add(domain)
+}
+
+// Returns the known recipient domains of a MX hostname
+func (proc *MxProcessor) Domains(hostname string) []string {
+	proc.domainsMutex.Lock()
+	defer proc.domainsMutex.Unlock()
+
+	if set, ok := proc.domains[hostname]; ok {
+		return setToStringArrays(set)
+	}
+	return nil
+}
+
 // If the hostname exists in the cache it returns its Value.
 // Otherwise is creates a job and returns nil.
 func (proc *MxProcessor) GetValue(hostname string) *string {
@@ -42,8 +100,9 @@ func (proc *MxProcessor) work(obj interface{}) {
 	entry, _ := obj.(*CacheEntry)
 	hostname := entry.Key
 
-	// Do the A/AAAA lookups
+	// Do the A/AAAA and TLSA lookups
 	mxAddresses := dnsProcessor.NewJobs(hostname, addressTypes)
+	tlsa := dnsProcessor.NewJob(tlsaName(hostname), TypeTLSA)
 	mxAddresses.Wait()
 
 	// Make addresses unique
@@ -55,7 +114,10 @@ func (proc *MxProcessor) work(obj interface{}) {
 	// Run the host checks
 	for i, addr := range addresses {
 		// Pass the access time from the host entry
-		jobs[i] = hostProcessor.NewJobWithAccessTime(net.ParseIP(addr), entry.Accessed)
+		// The MX hostname is sent via SNI
+		ip := net.ParseIP(addr)
+		jobs[i] = hostProcessor.NewJobWithAccessTime(&ScanTarget{Address: ip, Port: portSMTP, ServerName: hostname}, entry.Accessed)
+		hostProcessor.NewAdditionalJobs(ip, hostname, entry.Accessed)
 	}
 
 	// Wait for the host checks to be finished
@@ -66,6 +128,20 @@ func (proc *MxProcessor) work(obj interface{}) {
 	}
 
 	txtRecord := createTxtRecord(hostname, hosts)
+
+	// Validate the certificates against the TLSA records
+	tlsa.Wait()
+	txtRecord.dane = daneStatus(tlsa.Result, hostname, hosts)
+
+	// Match the certificates against the MX hostname, recipient domains and PTR names
+	txtRecord.matchNames(hostname, proc.Domains(hostname), hosts)
+
+	// Remember inconsistent IPv4 and IPv6 hosts for the report
+	proc.setDualStackReport(hostname, txtRecord.dualStack)
+
+	// Remember inconsistent addresses for the report
+	proc.setConsistencyReport(hostname, txtRecord.consistency)
+
 	txtString := txtRecord.String()
 
 	// Set value for the cache
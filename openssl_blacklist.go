@@ -15,6 +15,7 @@ import (
 	"github.com/zmap/zgrab/ztools/x509"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -23,7 +24,9 @@ type OpensslBlacklist struct {
 	sets map[int]mapset.Set
 }
 
-func NewOpensslBlacklist() (blacklist *OpensslBlacklist) {
+// Loads the blacklists from a directory.
+// Missing or invalid lists are reported and skipped.
+func NewOpensslBlacklist(directory string) (blacklist *OpensslBlacklist) {
 	blacklist = &OpensslBlacklist{
 		sets: make(map[int]mapset.Set),
 	}
@@ -32,14 +35,15 @@ func NewOpensslBlacklist() (blacklist *OpensslBlacklist) {
 
 	for _, size := range sizes {
 		set := mapset.NewThreadUnsafeSet()
-		path := "/usr/share/openssl-blacklist/blacklist.RSA-" + strconv.Itoa(size)
+		path := filepath.Join(directory, "blacklist.RSA-"+strconv.Itoa(size))
 
 		log.Println("Importing blacklist", path)
 
 		file, err := os.Open(path)
 		if err != nil {
-			log.Print(err)
-			log.Fatal("Please install required packages: apt-get install -y openssl-blacklist openssl-blacklist-extra")
+			log.Println(err)
+			log.Println("Please install required packages: apt-get install -y openssl-blacklist openssl-blacklist-extra")
+			continue
 		}
 
 		scanner := bufio.NewScanner(file)
@@ -47,7 +51,7 @@ func NewOpensslBlacklist() (blacklist *OpensslBlacklist) {
 			line := scanner.Text()
 			if !strings.HasPrefix(line, "#") {
 				if bytes, err := hex.DecodeString(line); err != nil {
-					log.Fatal(err)
+					log.Println("Invalid entry in", path, err)
 				} else {
 					set.Add(string(bytes))
 				}
@@ -61,22 +65,33 @@ func NewOpensslBlacklist() (blacklist *OpensslBlacklist) {
 	return blacklist
 }
 
-func (blacklist *OpensslBlacklist) Contains(cert *x509.Certificate) bool {
+func (blacklist *OpensslBlacklist) Name() string {
+	return "debian-openssl"
+}
+
+func (blacklist *OpensslBlacklist) Weak(cert *x509.Certificate) bool {
+	contained := blacklist.Contains(cert)
+	return contained != nil && *contained
+}
+
+// Returns nil if there is no list for the key
+func (blacklist *OpensslBlacklist) Contains(cert *x509.Certificate) *bool {
 	key, ok := cert.PublicKey.(*rsa.PublicKey)
 
 	if !ok {
-		return false
+		return nil
 	}
 
 	set, exist := blacklist.sets[key.N.BitLen()]
 
 	if !exist {
-		return false
+		return nil
 	}
 
 	modulus := []byte(strings.ToUpper(hex.EncodeToString(key.N.Bytes())))
 	bytes := append(append([]byte("Modulus="), modulus...), '\n')
 	fingerprint := []byte(x509.SHA1Fingerprint(bytes))
 
-	return set.Contains(string(fingerprint[10:]))
+	contained := set.Contains(string(fingerprint[10:]))
+	return &contained
 }
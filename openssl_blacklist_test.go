@@ -5,17 +5,17 @@ import (
 )
 
 func TestBlacklisted(t *testing.T) {
-	blacklist := NewOpensslBlacklist()
+	blacklist := NewOpensslBlacklist(opensslBlacklistDir)
 
 	// should not blacklisted
 	cert := parseCertificate("/usr/share/doc/openssl-blacklist/examples/good_x509.pem")
-	if blacklist.Contains(cert) {
+	if v := blacklist.Contains(cert); v == nil || *v {
 		t.Fatal("blacklisted")
 	}
 
 	// should be blacklisted
 	cert = parseCertificate("/usr/share/doc/openssl-blacklist/examples/bad_x509.pem")
-	if !blacklist.Contains(cert) {
+	if v := blacklist.Contains(cert); v == nil || !*v {
 		t.Fatal("not blacklisted")
 	}
 }
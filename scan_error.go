@@ -0,0 +1,164 @@
+package main
+
+import (
+	"github.com/zmap/zgrab/zlib"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Classes of host check errors, stored in mx_hosts.error_class
+const (
+	errorDns                 = "dns"
+	errorConnectRefused      = "connect-refused"
+	errorConnectTimeout      = "connect-timeout"
+	errorBannerTimeout       = "banner-timeout"
+	errorGreeting4xx         = "4xx-greeting"
+	errorGreeting5xx         = "5xx-greeting"
+	errorStarttlsUnsupported = "starttls-unsupported"
+	errorStarttlsRejected    = "starttls-rejected"
+	errorHandshakeFailure    = "handshake-failure"
+	errorCertificateParse    = "certificate-parse"
+	errorOther               = "other"
+)
+
+// Errors that are likely to disappear on the next attempt
+var transientErrorClasses = map[string]bool{
+	errorConnectTimeout: true,
+	errorBannerTimeout:  true,
+	errorGreeting4xx:    true,
+}
+
+// Errors that are unlikely to disappear soon
+var permanentErrorClasses = map[string]bool{
+	errorDns:            true,
+	errorConnectRefused: true,
+	errorGreeting5xx:    true,
+}
+
+// The stages of a host check
+const (
+	stageConnect = iota
+	stageGreeting
+	stageEhlo
+	stageStarttls
+	stageHandshake
+)
+
+// An error of a host check with its class
+type ScanError struct {
+	Class string
+	Err   error
+}
+
+func (err *ScanError) Error() string {
+	return err.Err.Error()
+}
+
+// Wraps an error that occured in the given stage
+func newScanError(stage int, err error) *ScanError {
+	return &ScanError{Class: classifyError(stage, err), Err: err}
+}
+
+// Classifies an error by the stage and the message
+func classifyError(stage int, err error) string {
+	if scanErr, ok := err.(*ScanError); ok {
+		return scanErr.Class
+	}
+
+	msg := err.Error()
+	timeout := isTimeout(err)
+
+	switch {
+	case strings.Contains(msg, "no such host"):
+		return errorDns
+	case strings.Contains(msg, "connection refused"):
+		return errorConnectRefused
+	}
+
+	switch stage {
+	case stageConnect:
+		if timeout {
+			return errorConnectTimeout
+		}
+	case stageGreeting:
+		if timeout {
+			return errorBannerTimeout
+		}
+		if class := greetingClass(replyCode(err)); class != "" {
+			return class
+		}
+	case stageStarttls:
+		switch code := replyCode(err); {
+		case code == 500 || code == 502:
+			return errorStarttlsUnsupported
+		case code == 0 && strings.Contains(msg, "not supported"):
+			return errorStarttlsUnsupported
+		}
+		return errorStarttlsRejected
+	case stageHandshake:
+		return errorHandshakeFailure
+	}
+
+	return errorOther
+}
+
+// The class of a greeting with a 4xx or 5xx reply code
+func greetingClass(code int) string {
+	switch code / 100 {
+	case 4:
+		return errorGreeting4xx
+	case 5:
+		return errorGreeting5xx
+	}
+	return ""
+}
+
+// The SMTP reply code of a textproto error or a raw response
+func replyCode(err error) int {
+	if protoErr, ok := err.(*textproto.Error); ok {
+		return protoErr.Code
+	}
+	return responseCode(err.Error())
+}
+
+// The reply code at the beginning of a raw response or 0
+func responseCode(response string) int {
+	if len(response) < 3 {
+		return 0
+	}
+	code, err := strconv.Atoi(response[:3])
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+func isTimeout(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return strings.HasSuffix(err.Error(), "i/o timeout")
+}
+
+// Classifies the error of a zgrab log entry by its event
+func classifyGrabError(data interface{}, err error) string {
+	switch data := data.(type) {
+	case *zlib.MailBannerEvent:
+		if class := greetingClass(responseCode(data.Banner)); class != "" {
+			return class
+		}
+		return classifyError(stageGreeting, err)
+	case *zlib.EHLOEvent:
+		return classifyError(stageEhlo, err)
+	case *zlib.StartTLSEvent:
+		if code := responseCode(data.Response); code != 0 {
+			return classifyError(stageStarttls, &textproto.Error{Code: code, Msg: data.Response})
+		}
+		return classifyError(stageStarttls, err)
+	case *zlib.TLSHandshakeEvent:
+		return classifyError(stageHandshake, err)
+	}
+	return classifyError(stageConnect, err)
+}
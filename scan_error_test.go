@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"github.com/zmap/zgrab/zlib"
+	"net/textproto"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		stage int
+		err   error
+		class string
+	}{
+		{stageConnect, errors.New("dial tcp: lookup mx.invalid: no such host"), errorDns},
+		{stageConnect, errors.New("dial tcp 192.0.2.1:25: connect: connection refused"), errorConnectRefused},
+		{stageConnect, errors.New("dial tcp 192.0.2.1:25: i/o timeout"), errorConnectTimeout},
+		{stageGreeting, errors.New("read tcp 192.0.2.1:25: i/o timeout"), errorBannerTimeout},
+		{stageGreeting, &textproto.Error{Code: 421, Msg: "too busy"}, errorGreeting4xx},
+		{stageGreeting, &textproto.Error{Code: 554, Msg: "no SMTP service here"}, errorGreeting5xx},
+		{stageStarttls, &textproto.Error{Code: 502, Msg: "command not implemented"}, errorStarttlsUnsupported},
+		{stageStarttls, &textproto.Error{Code: 454, Msg: "TLS not available"}, errorStarttlsRejected},
+		{stageHandshake, errors.New("remote error: tls: handshake failure"), errorHandshakeFailure},
+		{stageEhlo, errors.New("unexpected EOF"), errorOther},
+	}
+
+	for _, test := range tests {
+		if class := classifyError(test.stage, test.err); class != test.class {
+			t.Errorf("%v: expected %s, got %s", test.err, test.class, class)
+		}
+	}
+}
+
+func TestClassifyGrabError(t *testing.T) {
+	err := errors.New("Conversation error with remote host 192.0.2.1:25: Bad return code for STARTTLS")
+	if class := classifyGrabError(&zlib.StartTLSEvent{Response: "502 5.5.1 Unrecognized command"}, err); class != errorStarttlsUnsupported {
+		t.Fatal("unexpected class:", class)
+	}
+	if class := classifyGrabError(&zlib.MailBannerEvent{Banner: "421 Service not available"}, err); class != errorGreeting4xx {
+		t.Fatal("unexpected class:", class)
+	}
+	if class := classifyGrabError(nil, errors.New("dial tcp 192.0.2.1:25: i/o timeout")); class != errorConnectTimeout {
+		t.Fatal("unexpected class:", class)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"github.com/zmap/zgrab/ztools/ztls"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	versionTLS13 = 0x0304
+
+	portSMTP        = 25
+	portSubmissions = 465 // implicit TLS
+	portSubmission  = 587 // STARTTLS
+)
+
+var (
+	// TLS versions by their names used in -tlsVersions
+	tlsVersionNames = map[string]uint16{
+		"ssl3":   ztls.VersionSSL30,
+		"tls1.0": ztls.VersionTLS10,
+		"tls1.1": ztls.VersionTLS11,
+		"tls1.2": ztls.VersionTLS12,
+		"tls1.3": versionTLS13,
+	}
+)
+
+// The address, port and server name of a host check
+type ScanTarget struct {
+	Address    net.IP
+	Port       uint16
+	ServerName string // sent via SNI if not empty
+	Source     net.IP // local address to bind to, nil for the kernel's choice
+}
+
+// Port 465 expects the TLS handshake right after connecting
+func (target *ScanTarget) ImplicitTLS() bool {
+	return target.Port == portSubmissions
+}
+
+// The address for dialing
+func (target *ScanTarget) HostPort() string {
+	return net.JoinHostPort(target.Address.String(), strconv.Itoa(int(target.Port)))
+}
+
+func (target *ScanTarget) String() string {
+	if target.ServerName == "" {
+		return target.HostPort()
+	}
+	return target.HostPort() + "/" + target.ServerName
+}
+
+// Performs a single STARTTLS handshake with a host
+type Scanner interface {
+	// Connects to the host and negotiates up to the given TLS version.
+	// If cipherSuites is nil, the default cipher suites are offered.
+	Grab(target *ScanTarget, tlsVersion uint16, cipherSuites []uint16) *MxHostGrab
+
+	// The TLS versions supported by the backend
+	Versions() []uint16
+
+	// The cipher suites offered during the enumeration
+	CipherSuites() []uint16
+
+	// Are the cipher suites sent in the given order?
+	// Otherwise the server's order of preference can not be detected.
+	KeepsCipherOrder() bool
+}
+
+// Scanner backend using zgrab
+type ZgrabScanner struct{}
+
+func (scanner *ZgrabScanner) Grab(target *ScanTarget, tlsVersion uint16, cipherSuites []uint16) *MxHostGrab {
+	// Create a local copy of the default config
+	config := *zlibConfig
+	config.Port = target.Port
+	config.TLSVersion = tlsVersion // maximum TLS version
+	if cipherSuites != nil {
+		config.CipherSuite = cipherSuites
+	}
+	if target.ImplicitTLS() {
+		config.TLS = true
+		config.StartTLS = false
+	}
+
+	return grabWithConfig(&config, target)
+}
+
+func (scanner *ZgrabScanner) Versions() []uint16 {
+	return []uint16{ztls.VersionSSL30, ztls.VersionTLS10, ztls.VersionTLS11, ztls.VersionTLS12}
+}
+
+// ztls fails the handshake if the server selects
+// a suite it does not implement, which ends the enumeration.
+func (scanner *ZgrabScanner) CipherSuites() []uint16 {
+	return legacyCipherSuites()
+}
+
+func (scanner *ZgrabScanner) KeepsCipherOrder() bool {
+	return true
+}
+
+// Returns the scanner backend with the given name
+func NewScanner(name string) (Scanner, error) {
+	switch name {
+	case "zgrab":
+		if sourcePool != nil {
+			return nil, errors.New("the zgrab scanner does not support source addresses")
+		}
+		return &ZgrabScanner{}, nil
+	case "go":
+		return &GoScanner{
+			Timeout:    zlibConfig.Timeout,
+			EHLODomain: zlibConfig.EHLODomain,
+		}, nil
+	default:
+		return nil, errors.New("unknown scanner: " + name)
+	}
+}
+
+// Parses a comma separated list of TLS version names.
+// The result is sorted from the highest to the lowest version.
+func parseTLSVersions(str string) ([]uint16, error) {
+	versions := make([]uint16, 0)
+	for _, name := range strings.Split(str, ",") {
+		version, ok := tlsVersionNames[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.New("unknown TLS version: " + name)
+		}
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] > versions[j]
+	})
+
+	return versions, nil
+}
+
+// The versions to probe that are supported by the scanner, the highest first
+func scannerProbeVersions(scanner Scanner, versions []uint16) []uint16 {
+	supported := make(map[uint16]bool)
+	for _, version := range scanner.Versions() {
+		supported[version] = true
+	}
+
+	result := make([]uint16, 0, len(versions))
+	for _, version := range versions {
+		if supported[version] {
+			result = append(result, version)
+		}
+	}
+	return result
+}
+
+// Learns the accepted cipher suites of a TLS version in the order of the
+// server's preference by removing the selected suite from the offer.
+func enumerateCipherSuites(scanner Scanner, target *ScanTarget, tlsVersion uint16) []uint16 {
+	offer := scanner.CipherSuites()
+	accepted := make([]uint16, 0)
+
+	for len(offer) > 0 {
+		grab := scanner.Grab(target, tlsVersion, offer)
+		if !grab.TLSSuccessful() || uint16(grab.tlsVersion) != tlsVersion {
+			break
+		}
+
+		// Remove the selected suite from the offer
+		selected := uint16(grab.tlsCipherSuite)
+		remaining := make([]uint16, 0, len(offer))
+		for _, suite := range offer {
+			if suite != selected {
+				remaining = append(remaining, suite)
+			}
+		}
+
+		// Did the server select a suite we did not offer?
+		if len(remaining) == len(offer) {
+			break
+		}
+
+		accepted = append(accepted, selected)
+		offer = remaining
+	}
+
+	return accepted
+}
+
+// Offers the accepted suites in reverse order. The server enforces its
+// own preference if it still selects the first one.
+func hasServerCipherOrder(scanner Scanner, target *ScanTarget, tlsVersion uint16, accepted []uint16) bool {
+	if len(accepted) < 2 {
+		return false
+	}
+
+	reversed := make([]uint16, len(accepted))
+	for i, suite := range accepted {
+		reversed[len(accepted)-1-i] = suite
+	}
+
+	grab := scanner.Grab(target, tlsVersion, reversed)
+	return grab.TLSSuccessful() && uint16(grab.tlsVersion) == tlsVersion && uint16(grab.tlsCipherSuite) == accepted[0]
+}
+
+// Parses a comma separated list of ports
+func parsePorts(str string) ([]uint16, error) {
+	ports := make([]uint16, 0)
+	for _, field := range strings.Split(str, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, uint16(port))
+	}
+	return ports, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/zmap/zgrab/ztools/x509"
+	"github.com/zmap/zgrab/ztools/ztls"
+	"net"
+	"testing"
+)
+
+func TestParseTLSVersions(t *testing.T) {
+	versions, err := parseTLSVersions("tls1.0,tls1.3,ssl3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0] != versionTLS13 || versions[1] != ztls.VersionTLS10 || versions[2] != ztls.VersionSSL30 {
+		t.Fatal("unexpected value:", versions)
+	}
+
+	if _, err = parseTLSVersions("tls1.4"); err == nil {
+		t.Fatal("unknown version accepted")
+	}
+}
+
+func TestScannerProbeVersions(t *testing.T) {
+	versions := scannerProbeVersions(&ZgrabScanner{}, []uint16{versionTLS13, ztls.VersionTLS12})
+	if len(versions) != 1 || versions[0] != ztls.VersionTLS12 {
+		t.Fatal("unexpected value:", versions)
+	}
+}
+
+// Simulates a server with a fixed preference of cipher suites
+type fakeScanner struct {
+	preference  []uint16
+	clientOrder bool // select the first offered suite the server supports
+	grabs       int
+}
+
+func (scanner *fakeScanner) Grab(target *ScanTarget, tlsVersion uint16, cipherSuites []uint16) *MxHostGrab {
+	scanner.grabs++
+	outer, inner := scanner.preference, cipherSuites
+	if scanner.clientOrder {
+		outer, inner = cipherSuites, scanner.preference
+	}
+	for _, preferred := range outer {
+		for _, suite := range inner {
+			if suite == preferred {
+				return &MxHostGrab{
+					tlsVersion:     ztls.TLSVersion(tlsVersion),
+					tlsCipherSuite: ztls.CipherSuite(suite),
+					certificates:   []*x509.Certificate{&x509.Certificate{}},
+				}
+			}
+		}
+	}
+	return &MxHostGrab{}
+}
+
+func (scanner *fakeScanner) Versions() []uint16 {
+	return []uint16{ztls.VersionTLS12}
+}
+
+func (scanner *fakeScanner) CipherSuites() []uint16 {
+	return []uint16{0x002f, 0x0005, 0xc02f, 0xc030}
+}
+
+func (scanner *fakeScanner) KeepsCipherOrder() bool {
+	return true
+}
+
+func TestEnumerateCipherSuites(t *testing.T) {
+	scanner := &fakeScanner{preference: []uint16{0xc030, 0xc02f, 0x0005}}
+	suites := enumerateCipherSuites(scanner, &ScanTarget{Address: net.ParseIP("127.0.0.1"), Port: portSMTP}, ztls.VersionTLS12)
+
+	if len(suites) != 3 || suites[0] != 0xc030 || suites[1] != 0xc02f || suites[2] != 0x0005 {
+		t.Fatal("unexpected value:", suites)
+	}
+	if scanner.grabs != 4 {
+		t.Fatal("unexpected number of grabs:", scanner.grabs)
+	}
+}
+
+func TestServerCipherOrder(t *testing.T) {
+	target := &ScanTarget{Address: net.ParseIP("127.0.0.1"), Port: portSMTP}
+
+	scanner := &fakeScanner{preference: []uint16{0xc030, 0xc02f, 0x0005}}
+	if !hasServerCipherOrder(scanner, target, ztls.VersionTLS12, enumerateCipherSuites(scanner, target, ztls.VersionTLS12)) {
+		t.Fatal("server order not detected")
+	}
+
+	scanner = &fakeScanner{preference: []uint16{0xc030, 0xc02f, 0x0005}, clientOrder: true}
+	suites := enumerateCipherSuites(scanner, target, ztls.VersionTLS12)
+	if len(suites) != 3 || suites[0] != 0x0005 {
+		t.Fatal("unexpected value:", suites)
+	}
+	if hasServerCipherOrder(scanner, target, ztls.VersionTLS12, suites) {
+		t.Fatal("client order taken as server order")
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("25, 465,587")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 3 || ports[0] != portSMTP || ports[1] != portSubmissions || ports[2] != portSubmission {
+		t.Fatal("unexpected value:", ports)
+	}
+
+	if _, err = parsePorts("smtp"); err == nil {
+		t.Fatal("invalid port accepted")
+	}
+}
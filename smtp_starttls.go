@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A SMTP connection with the greeting and the EHLO response
+type smtpConn struct {
+	tls          *tls.Conn
+	localAddress net.IP  // nil if the connection has failed
+	starttls     *bool   // nil if the STARTTLS command has not been reached
+	banner       *string // the greeting
+	ehlo         *string // the EHLO response
+	tlsEhlo      *string // the EHLO response over TLS
+}
+
+// Connects to a SMTP server, issues STARTTLS and performs the TLS handshake.
+// The returned connection is never nil.
+func dialStarttls(target *ScanTarget, timeout time.Duration, ehloDomain string, config *tls.Config) (*smtpConn, error) {
+	result := &smtpConn{}
+
+	conn, err := smtpStarttls(target, timeout, ehloDomain, result)
+	if err != nil {
+		return result, err
+	}
+
+	// TLS Handshake
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return result, newScanError(stageHandshake, err)
+	}
+
+	// Some extensions like REQUIRETLS and AUTH are only announced over TLS
+	result.tlsEhlo = smtpEhlo(textproto.NewConn(tlsConn), ehloDomain)
+
+	result.tls = tlsConn
+	return result, nil
+}
+
+// Connects to a SMTP server and issues STARTTLS.
+// Returns the connection that is ready for the TLS handshake.
+func smtpStarttls(target *ScanTarget, timeout time.Duration, ehloDomain string, result *smtpConn) (net.Conn, error) {
+	conn, err := dialFrom(target.Source, target.HostPort(), timeout)
+	if err != nil {
+		return nil, newScanError(stageConnect, err)
+	}
+	result.localAddress = conn.LocalAddr().(*net.TCPAddr).IP
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	text := textproto.NewConn(conn)
+	starttls := false
+
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	// Greeting and EHLO
+	if err = smtpHello(text, ehloDomain, result); err != nil {
+		return fail(err)
+	}
+
+	// STARTTLS announced?
+	if !ehloHasExtension(*result.ehlo, "STARTTLS") {
+		result.starttls = &starttls
+		return fail(&ScanError{Class: errorStarttlsUnsupported, Err: errors.New("STARTTLS not supported")})
+	}
+
+	// STARTTLS
+	if err = text.PrintfLine("STARTTLS"); err != nil {
+		return fail(newScanError(stageStarttls, err))
+	}
+	result.starttls = &starttls
+	if _, _, err = text.ReadResponse(220); err != nil {
+		return fail(&ScanError{Class: classifyError(stageStarttls, err), Err: errors.New("Bad return code for STARTTLS")})
+	}
+	starttls = true
+
+	return conn, nil
+}
+
+// Connects to a SMTP server with implicit TLS, reads the greeting and sends EHLO.
+// The returned connection is never nil.
+func dialImplicitTLS(target *ScanTarget, timeout time.Duration, ehloDomain string, config *tls.Config) (*smtpConn, error) {
+	result := &smtpConn{}
+
+	conn, err := dialFrom(target.Source, target.HostPort(), timeout)
+	if err != nil {
+		return result, newScanError(stageConnect, err)
+	}
+	result.localAddress = conn.LocalAddr().(*net.TCPAddr).IP
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// TLS Handshake
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.Handshake()
+	success := err == nil
+	result.starttls = &success
+	if !success {
+		conn.Close()
+		return result, newScanError(stageHandshake, err)
+	}
+
+	// Greeting and EHLO
+	if err = smtpHello(textproto.NewConn(tlsConn), ehloDomain, result); err != nil {
+		conn.Close()
+		return result, err
+	}
+	result.tlsEhlo = result.ehlo
+
+	result.tls = tlsConn
+	return result, nil
+}
+
+// Reads the greeting and sends EHLO
+func smtpHello(text *textproto.Conn, ehloDomain string, result *smtpConn) error {
+	// Greeting
+	code, msg, err := text.ReadResponse(220)
+	if code != 0 {
+		banner := smtpResponseString(code, msg)
+		result.banner = &banner
+	}
+	if err != nil {
+		return newScanError(stageGreeting, err)
+	}
+
+	// EHLO
+	if err = text.PrintfLine("EHLO %s", ehloDomain); err != nil {
+		return newScanError(stageEhlo, err)
+	}
+	code, msg, err = text.ReadResponse(250)
+	if err != nil {
+		return newScanError(stageEhlo, err)
+	}
+	ehlo := smtpResponseString(code, msg)
+	result.ehlo = &ehlo
+
+	return nil
+}
+
+// Sends EHLO over an established TLS session. Returns nil on failure.
+func smtpEhlo(text *textproto.Conn, ehloDomain string) *string {
+	if err := text.PrintfLine("EHLO %s", ehloDomain); err != nil {
+		return nil
+	}
+	code, msg, err := text.ReadResponse(250)
+	if err != nil {
+		return nil
+	}
+	ehlo := smtpResponseString(code, msg)
+	return &ehlo
+}
+
+// Connects with crypto/tls to read the EHLO response over TLS.
+// zgrab does not send EHLO again after STARTTLS and does not record the local address.
+func (grab *MxHostGrab) fetchTlsEhlo(target *ScanTarget, timeout time.Duration, ehloDomain string) {
+	conn, err := dialStarttls(target, timeout, ehloDomain, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS10,
+		CipherSuites:       allCipherSuites(),
+		ServerName:         target.ServerName,
+	})
+	if err != nil {
+		return
+	}
+	conn.tls.Close()
+
+	grab.tlsEhlo = conn.tlsEhlo
+	if grab.sourceAddress == nil {
+		grab.sourceAddress = conn.localAddress
+	}
+}
+
+// Restores the raw multiline response from a textproto message
+func smtpResponseString(code int, msg string) string {
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		lines[i] = strconv.Itoa(code) + sep + line
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// Checks if the EHLO response contains an extension keyword
+func ehloHasExtension(response string, keyword string) bool {
+	extensions, _ := parseEhloResponse(response)
+	for _, extension := range extensions {
+		if extension == strings.ToUpper(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a raw EHLO response like "250-mx.example.com\r\n250-SIZE 1024\r\n250 AUTH PLAIN"
+// and returns the upper case extension keywords and the SASL mechanisms.
+func parseEhloResponse(response string) (extensions []string, authMechanisms []string) {
+	lines := strings.Split(strings.Replace(response, "\r\n", "\n", -1), "\n")
+
+	// The first line contains the domain
+	for _, line := range lines[1:] {
+		if len(line) >= 4 && (line[3] == '-' || line[3] == ' ') {
+			if _, err := strconv.Atoi(line[:3]); err == nil {
+				line = line[4:]
+			}
+		}
+		fields := strings.Fields(strings.ToUpper(line))
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Some servers still use the obsolete "AUTH=" syntax
+		keyword := fields[0]
+		if strings.HasPrefix(keyword, "AUTH=") {
+			fields = append([]string{"AUTH", keyword[5:]}, fields[1:]...)
+			keyword = "AUTH"
+		}
+
+		if keyword == "AUTH" {
+			for _, mechanism := range fields[1:] {
+				if !containsString(authMechanisms, mechanism) {
+					authMechanisms = append(authMechanisms, mechanism)
+				}
+			}
+		}
+		if !containsString(extensions, keyword) {
+			extensions = append(extensions, keyword)
+		}
+	}
+
+	return
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
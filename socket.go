@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 )
 
 func controlSocket() {
@@ -23,10 +24,11 @@ func controlSocket() {
 		}
 
 		go func() {
-			input := bufio.NewScanner(fd)
+			// The rest of the input is passed on unchanged, it may be compressed
+			input := bufio.NewReader(fd)
 			output := bufio.NewWriter(fd)
-			input.Scan()
-			if err = processCommand(input.Text(), input, output); err != nil {
+			command, _ := input.ReadString('\n')
+			if err = processCommand(strings.TrimSpace(command), input, output); err != nil {
 				output.WriteString(err.Error() + "\n")
 			}
 			output.Flush()
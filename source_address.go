@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Address families for -addressFamily
+const (
+	familyBoth = "both"
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// Source addresses for outgoing connections, used round-robin per family
+type SourcePool struct {
+	ipv4  []net.IP
+	ipv6  []net.IP
+	next4 uint32
+	next6 uint32
+}
+
+// Parses a comma separated list of IPv4 and IPv6 addresses
+func NewSourcePool(str string) (*SourcePool, error) {
+	pool := &SourcePool{}
+	for _, field := range strings.Split(str, ",") {
+		ip := net.ParseIP(strings.TrimSpace(field))
+		if ip == nil {
+			return nil, errors.New("invalid address: " + field)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			pool.ipv4 = append(pool.ipv4, ip4)
+		} else {
+			pool.ipv6 = append(pool.ipv6, ip)
+		}
+	}
+	return pool, nil
+}
+
+// Returns the next source address of the target's family.
+// Returns nil if the pool has no address of this family.
+func (pool *SourcePool) Next(target net.IP) net.IP {
+	if target.To4() != nil {
+		if len(pool.ipv4) == 0 {
+			return nil
+		}
+		return pool.ipv4[(atomic.AddUint32(&pool.next4, 1)-1)%uint32(len(pool.ipv4))]
+	}
+	if len(pool.ipv6) == 0 {
+		return nil
+	}
+	return pool.ipv6[(atomic.AddUint32(&pool.next6, 1)-1)%uint32(len(pool.ipv6))]
+}
+
+// The DNS types to resolve for an address family
+func familyAddressTypes(family string) ([]dns.Type, error) {
+	switch family {
+	case familyBoth:
+		return []dns.Type{TypeA, TypeAAAA}, nil
+	case familyIPv4:
+		return []dns.Type{TypeA}, nil
+	case familyIPv6:
+		return []dns.Type{TypeAAAA}, nil
+	default:
+		return nil, errors.New("unknown address family: " + family)
+	}
+}
+
+// Is the address allowed by -addressFamily?
+func familyAllowed(ip net.IP) bool {
+	switch addressFamily {
+	case familyIPv4:
+		return ip.To4() != nil
+	case familyIPv6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// Dials from the given source address if it is not nil
+func dialFrom(source net.IP, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if source != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: source}
+	}
+	return dialer.Dial("tcp", address)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/zmap/zgrab/ztools/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSourcePool(t *testing.T) {
+	pool, err := NewSourcePool("192.0.2.1, 192.0.2.2,2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v4 := net.ParseIP("198.51.100.1")
+	v6 := net.ParseIP("2001:db8:ffff::1")
+
+	if a, b, c := pool.Next(v4), pool.Next(v4), pool.Next(v4); a.String() != "192.0.2.1" || b.String() != "192.0.2.2" || c.String() != "192.0.2.1" {
+		t.Fatal("unexpected order:", a, b, c)
+	}
+	if source := pool.Next(v6); source.String() != "2001:db8::1" {
+		t.Fatal("unexpected value:", source)
+	}
+
+	if _, err = NewSourcePool("192.0.2.1,localhost"); err == nil {
+		t.Fatal("invalid address accepted")
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	defer func(family string) { addressFamily = family }(addressFamily)
+
+	types, err := familyAddressTypes(familyIPv6)
+	if err != nil || len(types) != 1 || types[0] != TypeAAAA {
+		t.Fatal("unexpected value:", types, err)
+	}
+	if _, err = familyAddressTypes("ipx"); err == nil {
+		t.Fatal("unknown family accepted")
+	}
+
+	addressFamily = familyIPv4
+	if !familyAllowed(net.ParseIP("192.0.2.1")) || familyAllowed(net.ParseIP("2001:db8::1")) {
+		t.Fatal("only IPv4 should be allowed")
+	}
+}
+
+// Records the source address of each grab
+type sourceRecorder struct {
+	*fakeScanner
+	certificate *x509.Certificate
+	sources     []net.IP
+}
+
+func (scanner *sourceRecorder) Grab(target *ScanTarget, tlsVersion uint16, cipherSuites []uint16) *MxHostGrab {
+	scanner.sources = append(scanner.sources, target.Source)
+	if cipherSuites == nil {
+		cipherSuites = scanner.CipherSuites()
+	}
+	grab := scanner.fakeScanner.Grab(target, tlsVersion, cipherSuites)
+	starttls := grab.TLSSuccessful()
+	grab.starttls = &starttls
+	if starttls {
+		grab.certificates = []*x509.Certificate{scanner.certificate}
+	}
+	return grab
+}
+
+func TestSourcePerHostCheck(t *testing.T) {
+	defer func(scanner Scanner, pool *SourcePool, enumerate bool) {
+		hostScanner, sourcePool, enumerateCiphers = scanner, pool, enumerate
+	}(hostScanner, sourcePool, enumerateCiphers)
+
+	certificate, err := x509.ParseCertificate(newFakeChain(t, time.Now().Add(time.Hour), "mx.example.test").certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := &sourceRecorder{fakeScanner: &fakeScanner{preference: []uint16{0xc030, 0xc02f}}, certificate: certificate}
+	hostScanner = scanner
+	sourcePool, _ = NewSourcePool("192.0.2.1,192.0.2.2")
+	enumerateCiphers = true
+
+	NewMxHostSummary(&ScanTarget{Address: net.ParseIP("198.51.100.1"), Port: portSMTP, ServerName: "mx.example.test"})
+
+	if len(scanner.sources) < 3 {
+		t.Fatal("unexpected number of grabs:", len(scanner.sources))
+	}
+	for _, source := range scanner.sources {
+		if !source.Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatal("unexpected source addresses:", scanner.sources)
+		}
+	}
+}
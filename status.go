@@ -35,10 +35,66 @@ func status() ([]byte, error) {
 	if resultProcessor != nil {
 		m["result"] = poolStatus(resultProcessor.workers)
 	}
+	m["mta"] = mtaStatus(hostProcessor.cache)
+	m["host_errors"] = errorStatus(hostProcessor.cache)
 
 	return json.Marshal(m)
 }
 
+// Counts the cached hosts and their TLS weaknesses per MTA product and version
+func mtaStatus(cache *CachedWorkerPool) map[string]map[string]int {
+	m := make(map[string]map[string]int)
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	for _, entry := range cache.cache {
+		summary, ok := entry.Value.(*MxHostSummary)
+		if !ok || summary.mtaProduct == nil {
+			continue
+		}
+
+		name := *summary.mtaProduct
+		if summary.mtaVersion != nil {
+			name += " " + *summary.mtaVersion
+		}
+
+		counts, ok := m[name]
+		if !ok {
+			counts = make(map[string]int)
+			m[name] = counts
+		}
+		counts["hosts"]++
+		if summary.Starttls != nil && !*summary.Starttls {
+			counts["no_starttls"]++
+		}
+		if summary.HasWeakCipherSuite() {
+			counts["weak_ciphers"]++
+		}
+		if summary.validity != nil && summary.validity.Expired {
+			counts["expired"]++
+		}
+	}
+
+	return m
+}
+
+// Counts the cached hosts per error class
+func errorStatus(cache *CachedWorkerPool) map[string]int {
+	m := make(map[string]int)
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	for _, entry := range cache.cache {
+		if summary, ok := entry.Value.(*MxHostSummary); ok && summary.ErrorClass != nil {
+			m[*summary.ErrorClass]++
+		}
+	}
+
+	return m
+}
+
 type KeyConverter func(string) string
 
 // Returns the cache content for a CachedWorkerPool as JSON
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/zmap/zgrab/zlib"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	transcriptSuffix = ".json.gz"
+	transcriptIndex  = "index" // lines with the time of a host check and the hash of its transcript
+)
+
+var (
+	transcriptArchive *TranscriptArchive // set by -archiveDir
+)
+
+// The raw grabs of a host check
+type Transcript struct {
+	Address    net.IP       `json:"address"`
+	Port       uint16       `json:"port"`
+	ServerName string       `json:"server_name,omitempty"`
+	Updated    time.Time    `json:"-"`     // the latest time in the index
+	Grabs      []*zlib.Grab `json:"grabs"` // the first grab and the version probes, without their time
+}
+
+// Stores gzip compressed transcripts named by the SHA-256 of their content.
+// Repeated host checks with the same results share a file,
+// the index records the time of each check.
+type TranscriptArchive struct {
+	dir   string
+	mutex sync.Mutex // for appending to the index
+}
+
+func NewTranscriptArchive(dir string) *TranscriptArchive {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalln("unable to create archiveDir:", err)
+	}
+	return &TranscriptArchive{dir: dir}
+}
+
+// Archives the transcript of the summary and sets its hash.
+// Summaries of the go scanner have no transcript.
+func (archive *TranscriptArchive) Save(summary *MxHostSummary) error {
+	if len(summary.transcripts) == 0 {
+		return nil
+	}
+
+	// The time of the grabs would make every transcript unique
+	grabs := make([]*zlib.Grab, len(summary.transcripts))
+	for i, grab := range summary.transcripts {
+		copied := *grab
+		copied.Time = time.Time{}
+		grabs[i] = &copied
+	}
+
+	raw, err := json.Marshal(&Transcript{
+		Address:    summary.address,
+		Port:       summary.port,
+		ServerName: summary.serverName,
+		Grabs:      grabs,
+	})
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(raw)
+	hash := hex.EncodeToString(sum[:])
+	path := archive.path(hash)
+
+	// Identical content has already been archived, only the time is added
+	if _, err := os.Stat(path); err == nil {
+		summary.transcript = &hash
+		return archive.appendIndex(summary.Updated, hash)
+	}
+
+	buffer := new(bytes.Buffer)
+	writer := gzip.NewWriter(buffer)
+	writer.Write(raw)
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first to avoid partial transcripts
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	summary.transcript = &hash
+	return archive.appendIndex(summary.Updated, hash)
+}
+
+// Records the time of a host check with the given transcript
+func (archive *TranscriptArchive) appendIndex(updated time.Time, hash string) error {
+	archive.mutex.Lock()
+	defer archive.mutex.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(archive.dir, transcriptIndex), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteString(updated.UTC().Format(time.RFC3339Nano) + " " + hash + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Returns the latest time of each archived transcript
+func (archive *TranscriptArchive) Index() (map[string]time.Time, error) {
+	file, err := os.Open(filepath.Join(archive.dir, transcriptIndex))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make(map[string]time.Time)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		updated, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			continue
+		}
+		if previous, ok := result[fields[1]]; !ok || updated.After(previous) {
+			result[fields[1]] = updated
+		}
+	}
+	return result, scanner.Err()
+}
+
+// Reads the transcript with the given hash
+func (archive *TranscriptArchive) Load(hash string) (*Transcript, error) {
+	file, err := os.Open(archive.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	transcript := &Transcript{}
+	if err = json.NewDecoder(reader).Decode(transcript); err != nil {
+		return nil, err
+	}
+	if len(transcript.Grabs) == 0 {
+		return nil, errors.New("transcript without grabs: " + hash)
+	}
+	return transcript, nil
+}
+
+// Transcripts are spread over subdirectories by the first two characters of the hash
+func (archive *TranscriptArchive) path(hash string) string {
+	return filepath.Join(archive.dir, hash[:2], hash+transcriptSuffix)
+}
+
+// Rebuilds the summary from the grabs without connecting
+func (transcript *Transcript) Summary() *MxHostSummary {
+	grabs := make([]*MxHostGrab, len(transcript.Grabs))
+	for i, grab := range transcript.Grabs {
+		grabs[i] = newMxHostGrabFromBanner(grab)
+	}
+	target := &ScanTarget{Address: transcript.Address, Port: transcript.Port, ServerName: transcript.ServerName}
+	return NewMxHostSummaryFromGrabs(target, grabs, transcript.Updated)
+}
+
+// Rebuilds the summaries of the latest transcript of each host and the TXT
+// records of the MX hostnames. The columns of the summaries that can be derived
+// from the transcripts are saved in the database, the TXT records are saved
+// and published like the ones of imported hosts.
+func reanalyzeTranscripts(output *bufio.Writer) error {
+	if transcriptArchive == nil {
+		return errors.New("reanalyze requires -archiveDir")
+	}
+
+	index, err := transcriptArchive.Index()
+	if err != nil {
+		return err
+	}
+
+	// The latest transcript of each host
+	latest := make(map[string]*Transcript)
+	hashes := make(map[string]string)
+
+	for hash, updated := range index {
+		transcript, err := transcriptArchive.Load(hash)
+		if err != nil {
+			log.Println("Unable to load transcript:", err)
+			continue
+		}
+		transcript.Updated = updated
+		key := hostKey(&ScanTarget{Address: transcript.Address, Port: transcript.Port, ServerName: transcript.ServerName})
+		if previous, ok := latest[key]; !ok || transcript.Updated.After(previous.Updated) {
+			latest[key] = transcript
+			hashes[key] = hash
+		}
+	}
+
+	hosts := make(map[string][]*MxHostSummary)
+	for key, transcript := range latest {
+		summary := transcript.Summary()
+		hash := hashes[key]
+		summary.transcript = &hash
+		saveHostSummary(summary)
+
+		// The policy is only based on port 25
+		if transcript.Port == portSMTP && transcript.ServerName != "" {
+			hosts[transcript.ServerName] = append(hosts[transcript.ServerName], summary)
+		}
+	}
+
+	hostnames := make([]string, 0, len(hosts))
+	for hostname := range hosts {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	// The TXT records lack the results of the other connections
+	for _, hostname := range hostnames {
+		mxProcessor.importHosts(hostname, hosts[hostname], output)
+	}
+	output.Flush()
+
+	log.Println("Reanalyzed", len(latest), "transcripts of", len(hosts), "MX hostnames")
+	return nil
+}
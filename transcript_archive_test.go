@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/zmap/zgrab/zlib"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTranscriptArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	transcriptArchive = NewTranscriptArchive(dir)
+	mxProcessor = NewMxProcessor(1, NewCacheConfig(600, 0, 60))
+	defer func() {
+		transcriptArchive = nil
+		mxProcessor.Close()
+		mxProcessor = nil
+	}()
+
+	address := net.ParseIP("192.0.2.1")
+	target := &ScanTarget{Address: address, Port: portSMTP, ServerName: "mx.example.com"}
+	grab := &MxHostGrab{transcript: &zlib.Grab{Host: address, Domain: target.ServerName}}
+	summary := NewMxHostSummaryFromGrabs(target, []*MxHostGrab{grab}, time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	if err := transcriptArchive.Save(summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.transcript == nil {
+		t.Fatal("hash not set")
+	}
+
+	// A later check with the same results gets the same hash
+	hash := *summary.transcript
+	grab.transcript.Time = time.Date(2017, 1, 3, 3, 4, 5, 0, time.UTC)
+	summary = NewMxHostSummaryFromGrabs(target, []*MxHostGrab{grab}, grab.transcript.Time)
+	if transcriptArchive.Save(summary); summary.transcript == nil || *summary.transcript != hash {
+		t.Fatal("hash differs")
+	}
+
+	// The time of the latest check survives copying the files
+	os.Chtimes(transcriptArchive.path(hash), time.Time{}, time.Time{})
+	index, err := transcriptArchive.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated, ok := index[hash]; len(index) != 1 || !ok || !updated.Equal(summary.Updated) {
+		t.Fatal("unexpected index:", index)
+	}
+
+	transcript, err := transcriptArchive.Load(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript.Updated = index[hash]
+	rebuilt := transcript.Summary()
+	if !rebuilt.address.Equal(address) || rebuilt.port != portSMTP || rebuilt.serverName != "mx.example.com" || !rebuilt.Updated.Equal(summary.Updated) {
+		t.Fatal("unexpected summary:", rebuilt)
+	}
+	if !rebuilt.partial {
+		t.Fatal("rebuilt summary should be partial")
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := reanalyzeTranscripts(bufio.NewWriter(buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if result := buffer.String(); result != "mx.example.com starttls=false\n" {
+		t.Fatal("unexpected output:", result)
+	}
+	if value := mxProcessor.GetValue("mx.example.com"); value == nil || *value != "starttls=false" {
+		t.Fatal("TXT record not saved:", value)
+	}
+}
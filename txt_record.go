@@ -8,12 +8,19 @@ import (
 
 type TxtRecord struct {
 	domain       string
-	starttls     bool       // true if all reachable hosts have starttls
-	fingerprints mapset.Set // the union of all hosts
-	certProblems mapset.Set // the union of all hosts
-	tlsVersions  mapset.Set // the intersection of all hosts
-	tlsCiphers   mapset.Set // the intersection of all hosts
-	trusted      mapset.Set // the intersection of all hosts: list of root stores with a valid chain
+	starttls     bool               // true if all reachable hosts have starttls
+	fingerprints mapset.Set         // the union of all hosts
+	certProblems mapset.Set         // the union of all hosts
+	problems     mapset.Set         // the union of all hosts: problems of the TLS configuration
+	tlsVersions  mapset.Set         // the intersection of all hosts
+	tlsCiphers   mapset.Set         // the intersection of all hosts
+	trusted      mapset.Set         // the intersection of all hosts: list of root stores with a valid chain
+	dane         string             // DANE status of the TLSA records
+	certNames    mapset.Set         // the intersection of all hosts: kinds of names the certificates are valid for
+	matchedNames mapset.Set         // the union of all hosts: names the certificates are valid for
+	requireTLS   bool               // true if all hosts with TLS announce REQUIRETLS
+	dualStack    *DualStackReport   // nil if not dual-stack
+	consistency  *ConsistencyReport // nil for a single address
 	updatedAt    int64
 }
 
@@ -43,6 +50,12 @@ func createTxtRecord(hostname string, hosts []*MxHostSummary) (record TxtRecord)
 			}
 		}
 	}
+	// Compare the IPv4 and IPv6 hosts
+	record.dualStack = compareDualStack(hostname, hosts)
+
+	// Compare all addresses, e.g. behind a load balancer
+	record.consistency = compareAddresses(hostname, hosts)
+
 	if !record.starttls {
 		// no sense to go further
 		return
@@ -50,7 +63,17 @@ func createTxtRecord(hostname string, hosts []*MxHostSummary) (record TxtRecord)
 
 	record.fingerprints = mapset.NewThreadUnsafeSet()
 	record.certProblems = mapset.NewThreadUnsafeSet()
+	record.problems = mapset.NewThreadUnsafeSet()
 	record.trusted = mapset.NewThreadUnsafeSet()
+	record.requireTLS = true
+
+	if record.dualStack != nil && len(record.dualStack.Differences) > 0 {
+		record.problems.Add("dual-stack")
+	}
+
+	if record.consistency != nil && record.consistency.Verdict == verdictInconsistent {
+		record.problems.Add("inconsistent")
+	}
 
 	for _, host := range hosts {
 		if host.tlsVersions != nil {
@@ -68,6 +91,24 @@ func createTxtRecord(hostname string, hosts []*MxHostSummary) (record TxtRecord)
 				record.trusted = record.trusted.Intersect(validity.TrustedNames())
 			}
 
+			if host.HasWeakCipherSuite() {
+				record.problems.Add("weak-ciphers")
+			}
+
+			if host.HasWeakDH() {
+				record.problems.Add("weak-dh")
+			}
+
+			if host.vulnerabilities != nil {
+				for _, problem := range host.vulnerabilities.Problems() {
+					record.problems.Add(problem)
+				}
+			}
+
+			if !host.HasExtension("REQUIRETLS") {
+				record.requireTLS = false
+			}
+
 			// Has the server certificate been parsed successfully?
 			if fingerprint := host.ServerFingerprint(); fingerprint != nil {
 				record.fingerprints.Add(string(*fingerprint))
@@ -85,6 +126,55 @@ func createTxtRecord(hostname string, hosts []*MxHostSummary) (record TxtRecord)
 	return
 }
 
+// Checks the server certificates against the MX hostname, the recipient domains and the PTR names
+func (record *TxtRecord) matchNames(hostname string, domains []string, hosts []*MxHostSummary) {
+	if !record.starttls {
+		return
+	}
+
+	record.matchedNames = mapset.NewThreadUnsafeSet()
+
+	for _, host := range hosts {
+		if host.ServerFingerprint() == nil {
+			continue
+		}
+
+		kinds := mapset.NewThreadUnsafeSet()
+
+		if host.CertificateValidForDomain(hostname) {
+			kinds.Add("mx")
+			record.matchedNames.Add(hostname)
+		}
+
+		// All recipient domains must match
+		allDomains := len(domains) > 0
+		for _, domain := range domains {
+			if host.CertificateValidForDomain(domain) {
+				record.matchedNames.Add(domain)
+			} else {
+				allDomains = false
+			}
+		}
+		if allDomains {
+			kinds.Add("domain")
+		}
+
+		// Any PTR name may match
+		for _, ptrName := range host.ptrNames {
+			if host.CertificateValidForDomain(ptrName) {
+				kinds.Add("ptr")
+				record.matchedNames.Add(ptrName)
+			}
+		}
+
+		if record.certNames == nil {
+			record.certNames = kinds
+		} else {
+			record.certNames = record.certNames.Intersect(kinds)
+		}
+	}
+}
+
 // String representation
 func (record *TxtRecord) String() string {
 	buffer := new(bytes.Buffer)
@@ -104,6 +194,10 @@ func (record *TxtRecord) String() string {
 		addValue("starttls", "false")
 	}
 
+	if record.dane != "" {
+		addValue("dane", record.dane)
+	}
+
 	if !record.starttls {
 		return buffer.String()
 	}
@@ -130,6 +224,18 @@ func (record *TxtRecord) String() string {
 		if record.certProblems.Cardinality() > 0 {
 			addValue("certificate-problems", joinSet(record.certProblems, false))
 		}
+
+		if record.problems.Cardinality() > 0 {
+			addValue("problems", joinSet(record.problems, false))
+		}
+
+		if record.certNames != nil && record.certNames.Cardinality() > 0 {
+			addValue("certificate-names", joinSet(record.certNames, false))
+		}
+
+		if txtRequireTLS && record.requireTLS {
+			addValue("requiretls", "yes")
+		}
 	}
 
 	return buffer.String()
@@ -71,3 +71,18 @@ func parseCertificate(name string) *x509.Certificate {
 	cert, _ := x509.ParseCertificate(p.Bytes)
 	return cert
 }
+
+func TestTxtMatchNames(t *testing.T) {
+	cert := parseCertificate("testdata/example.com.crt")
+	host := &MxHostSummary{Starttls: &True, fingerprints: [][]byte{[]byte("foo")}, certificates: []*x509.Certificate{cert}, ptrNames: []string{"other.example.net", "example.com"}}
+
+	record := TxtRecord{starttls: true}
+	record.matchNames("mx.example.net", []string{"example.com"}, []*MxHostSummary{host})
+
+	if record.certNames.Cardinality() != 2 || !record.certNames.Contains("domain", "ptr") {
+		t.Fatal("unexpected certificate names:", record.certNames)
+	}
+	if record.matchedNames.Cardinality() != 1 || !record.matchedNames.Contains("example.com") {
+		t.Fatal("unexpected matched names:", record.matchedNames)
+	}
+}
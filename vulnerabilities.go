@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/zmap/zgrab/ztools/ztls"
+	"strings"
+)
+
+// Results of the TLS vulnerability probes. Nil values are unknown.
+type TlsVulnerabilities struct {
+	Compression           *bool
+	InsecureRenegotiation *bool
+	FallbackSCSV          *bool // true if a downgraded handshake is rejected
+	Heartbeat             *bool // the extension is present
+	RC4                   *bool
+	Export                *bool
+	ClientCertRequested   *bool
+}
+
+// Copies the passive results of the first handshake and runs the active probes
+func (summary *MxHostSummary) probeVulnerabilities(target *ScanTarget, first *MxHostGrab, versions []uint16) {
+	vulns := passiveVulnerabilities(first)
+	summary.vulnerabilities = vulns
+
+	if !probeVulnerabilities {
+		return
+	}
+
+	// The highest negotiated version below TLS 1.3 for the cipher suite probes
+	var legacyVersion uint16
+	for _, version := range versions {
+		if version < versionTLS13 && summary.HasTLSVersion(version) {
+			legacyVersion = version
+			break
+		}
+	}
+	if legacyVersion != 0 {
+		vulns.RC4 = summary.acceptsCipherSuites(target, legacyVersion, "_RC4_")
+		vulns.Export = summary.acceptsCipherSuites(target, legacyVersion, "_EXPORT_")
+	}
+
+	vulns.FallbackSCSV = summary.rejectsFallback(target, versions)
+}
+
+// The results known from a single handshake
+func passiveVulnerabilities(grab *MxHostGrab) *TlsVulnerabilities {
+	vulns := &TlsVulnerabilities{
+		Heartbeat:           grab.heartbeat,
+		Compression:         grab.compression,
+		ClientCertRequested: grab.clientCertRequested,
+	}
+	if grab.secureRenegotiation != nil {
+		insecure := !*grab.secureRenegotiation
+		vulns.InsecureRenegotiation = &insecure
+	}
+	return vulns
+}
+
+// Does the host accept any suite whose name contains the given part?
+func (summary *MxHostSummary) acceptsCipherSuites(target *ScanTarget, version uint16, part string) *bool {
+	accepted := false
+
+	// The enumeration already knows the answer
+	if summary.acceptedCiphers != nil {
+		for _, suite := range summary.acceptedCiphers[version] {
+			if strings.Contains(cipherSuiteNames[suite], part) {
+				accepted = true
+			}
+		}
+		return &accepted
+	}
+
+	offer := make([]uint16, 0)
+	for _, suite := range hostScanner.CipherSuites() {
+		if strings.Contains(cipherSuiteNames[suite], part) {
+			offer = append(offer, suite)
+		}
+	}
+	if len(offer) == 0 {
+		// not supported by the backend
+		return nil
+	}
+
+	if grab := hostScanner.Grab(target, version, offer); grab.TLSSuccessful() {
+		for _, suite := range offer {
+			if uint16(grab.tlsCipherSuite) == suite {
+				accepted = true
+			}
+		}
+	}
+	return &accepted
+}
+
+// The problems for the policy
+func (vulns *TlsVulnerabilities) Problems() []string {
+	problems := make([]string, 0)
+	isTrue := func(value *bool) bool {
+		return value != nil && *value
+	}
+
+	if isTrue(vulns.Compression) {
+		problems = append(problems, "compression")
+	}
+	if isTrue(vulns.InsecureRenegotiation) {
+		problems = append(problems, "insecure-renegotiation")
+	}
+	if vulns.FallbackSCSV != nil && !*vulns.FallbackSCSV {
+		problems = append(problems, "no-fallback-scsv")
+	}
+	if isTrue(vulns.RC4) {
+		problems = append(problems, "rc4")
+	}
+	if isTrue(vulns.Export) {
+		problems = append(problems, "export")
+	}
+	return problems
+}
+
+// Copies the passive results from the ServerHello.
+// The heartbeat stays unknown as zgrab does not offer the extension.
+func (result *MxHostGrab) setHelloFlags(hello *ztls.ServerHello) {
+	compression := hello.CompressionMethod != 0
+	result.compression = &compression
+	result.secureRenegotiation = &hello.SecureRenegotiation
+}
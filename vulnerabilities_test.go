@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/zmap/zgrab/ztools/ztls"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProbeVulnerabilities(t *testing.T) {
+	defer func(scanner Scanner, probe bool) { hostScanner, probeVulnerabilities = scanner, probe }(hostScanner, probeVulnerabilities)
+	hostScanner = &fakeScanner{preference: []uint16{0xc02f, 0x0005}}
+	probeVulnerabilities = true
+
+	target := &ScanTarget{Address: net.ParseIP("127.0.0.1"), Port: portSMTP}
+	first := hostScanner.Grab(target, ztls.VersionTLS12, hostScanner.CipherSuites())
+	secure := false
+	first.secureRenegotiation = &secure
+
+	summary := &MxHostSummary{}
+	summary.Append(first)
+	summary.probeVulnerabilities(target, first, []uint16{ztls.VersionTLS12})
+
+	vulns := summary.vulnerabilities
+	if vulns.RC4 == nil || !*vulns.RC4 {
+		t.Fatal("RC4 should be accepted")
+	}
+	if vulns.Export != nil {
+		t.Fatal("unsupported probe should be unknown")
+	}
+	if problems := strings.Join(vulns.Problems(), ","); problems != "insecure-renegotiation,rc4" {
+		t.Fatal("unexpected problems:", problems)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/zmap/zgrab/zlib"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	zgrabFile string            // set by -zgrabFile, the input of the command if empty
+	zgrabPort uint   = portSMTP // set by -zgrabPort
+)
+
+// Decodes the JSON lines written by zgrab, plain or gzip compressed
+type ZgrabDecoder struct {
+	decoder *json.Decoder
+}
+
+func NewZgrabDecoder(reader io.Reader) (*ZgrabDecoder, error) {
+	buffered := bufio.NewReader(reader)
+
+	// Check for the gzip magic number
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return &ZgrabDecoder{decoder: json.NewDecoder(gzipReader)}, nil
+	}
+
+	return &ZgrabDecoder{decoder: json.NewDecoder(buffered)}, nil
+}
+
+// Returns the next *zlib.Grab or io.EOF
+func (d *ZgrabDecoder) DecodeNext() (interface{}, error) {
+	grab := &zlib.Grab{}
+	if err := d.decoder.Decode(grab); err != nil {
+		return nil, err
+	}
+	return grab, nil
+}
+
+// Imports the zgrab output from -zgrabFile or the input of the command
+// and writes the TXT records of the MX hostnames
+func importZgrabFile(reader io.Reader, output *bufio.Writer) error {
+	if zgrabFile != "" {
+		file, err := os.Open(zgrabFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	decoder, err := NewZgrabDecoder(reader)
+	if err != nil {
+		return err
+	}
+	return importZgrab(decoder, output)
+}
+
+// Runs the validity, database and policy pipeline on the decoded grabs.
+// The domain of a grab is the MX hostname, it has been sent via SNI.
+// The grabs of a MX hostname must be adjacent, e.g. sorted by the domain.
+// TXT records are only written for grabs of port 25.
+func importZgrab(decoder Decoder, output *bufio.Writer) error {
+	count := 0
+	imported := 0
+
+	// The grabs of the current MX hostname
+	var hostname string
+	var hosts []*MxHostSummary
+	finished := make(map[string]bool)
+
+	flush := func() {
+		if hostname != "" {
+			mxProcessor.importHosts(hostname, hosts, output)
+			finished[hostname] = true
+			imported++
+		}
+		hostname, hosts = "", nil
+	}
+	defer output.Flush()
+
+	for {
+		obj, err := decoder.DecodeNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		grab := obj.(*zlib.Grab)
+		if grab.Host == nil || !familyAllowed(grab.Host) {
+			continue
+		}
+
+		// zgrab does not log the port
+		target := &ScanTarget{Address: grab.Host, Port: uint16(zgrabPort), ServerName: grab.Domain}
+		updated := grab.Time
+		if updated.IsZero() {
+			updated = time.Now()
+		}
+
+		summary := NewMxHostSummaryFromGrabs(target, []*MxHostGrab{newMxHostGrabFromBanner(grab)}, updated)
+		saveHostSummary(summary)
+		count++
+
+		if grab.Domain == "" || target.Port != portSMTP {
+			continue
+		}
+		if grab.Domain != hostname {
+			flush()
+			if finished[grab.Domain] {
+				return errors.New("zgrab output is not grouped by the domain: " + grab.Domain)
+			}
+			hostname = grab.Domain
+		}
+		hosts = append(hosts, summary)
+	}
+	flush()
+
+	log.Println("Imported", count, "grabs of", imported, "MX hostnames")
+	return nil
+}
+
+// Creates the TXT record from hosts checked elsewhere. The TLSA records are not looked up.
+func (proc *MxProcessor) importedTxtRecord(hostname string, hosts []*MxHostSummary) *TxtRecord {
+	txtRecord := createTxtRecord(hostname, hosts)
+	txtRecord.matchNames(hostname, proc.Domains(hostname), hosts)
+	proc.setDualStackReport(hostname, txtRecord.dualStack)
+	proc.setConsistencyReport(hostname, txtRecord.consistency)
+	return &txtRecord
+}
+
+// Writes the TXT record of imported hosts and saves it like the work function does
+func (proc *MxProcessor) importHosts(hostname string, hosts []*MxHostSummary, output *bufio.Writer) {
+	txtRecord := proc.importedTxtRecord(hostname, hosts)
+	txtString := txtRecord.String()
+	output.WriteString(hostname + " " + txtString + "\n")
+
+	proc.cache.Set(hostname, &txtString)
+
+	if nsUpdater != nil {
+		nsUpdater.NewJob(hostname, txtString)
+	}
+	if resultProcessor != nil {
+		resultProcessor.Add(&MxRecord{importedAddresses(hostname, hosts), txtRecord})
+	}
+}
+
+// A finished lookup with the addresses of the imported hosts
+func importedAddresses(hostname string, hosts []*MxHostSummary) *DnsJobs {
+	addresses := make([]string, len(hosts))
+	for i, host := range hosts {
+		addresses[i] = host.address.String()
+	}
+	job := &DnsJob{
+		Query:  &DnsQuery{Domain: hostname, Type: TypeA},
+		Result: &DnsResult{Results: UniqueStrings(addresses)},
+	}
+	return &DnsJobs{jobs: []*DnsJob{job}}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"github.com/zmap/zgrab/zlib"
+	"io"
+	"strings"
+	"testing"
+)
+
+const zgrabOutput = `{"host":"192.0.2.1","domain":"mx.example.com","time":"2017-01-02T03:04:05Z"}
+{"host":"2001:db8::1","domain":"mx.example.com","time":"2017-01-02T03:04:06Z"}
+`
+
+func decodeGrabs(t *testing.T, decoder Decoder) []*zlib.Grab {
+	grabs := make([]*zlib.Grab, 0)
+	for {
+		obj, err := decoder.DecodeNext()
+		if err == io.EOF {
+			return grabs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		grabs = append(grabs, obj.(*zlib.Grab))
+	}
+}
+
+func compressZgrabOutput() *bytes.Buffer {
+	compressed := new(bytes.Buffer)
+	writer := gzip.NewWriter(compressed)
+	writer.Write([]byte(zgrabOutput))
+	writer.Close()
+	return compressed
+}
+
+func TestZgrabDecoder(t *testing.T) {
+	for _, input := range []io.Reader{bytes.NewBufferString(zgrabOutput), compressZgrabOutput()} {
+		decoder, err := NewZgrabDecoder(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		grabs := decodeGrabs(t, decoder)
+		if len(grabs) != 2 {
+			t.Fatal("unexpected number of grabs:", len(grabs))
+		}
+		if grabs[1].Host.String() != "2001:db8::1" || grabs[1].Domain != "mx.example.com" {
+			t.Fatal("unexpected grab:", grabs[1])
+		}
+	}
+}
+
+func TestImportZgrab(t *testing.T) {
+	mxProcessor = NewMxProcessor(1, NewCacheConfig(600, 0, 60))
+	defer func() {
+		mxProcessor.Close()
+		mxProcessor = nil
+	}()
+
+	// Read from the input of the command, plain and compressed
+	for _, input := range []io.Reader{bytes.NewBufferString(zgrabOutput), compressZgrabOutput()} {
+		buffer := new(bytes.Buffer)
+		if err := processCommand("import-zgrab", input, bufio.NewWriter(buffer)); err != nil {
+			t.Fatal(err)
+		}
+		if result := buffer.String(); result != "mx.example.com starttls=false\n" {
+			t.Fatal("unexpected output:", result)
+		}
+		if value := mxProcessor.GetValue("mx.example.com"); value == nil || *value != "starttls=false" {
+			t.Fatal("TXT record not cached:", value)
+		}
+	}
+
+	// Lines longer than the limit of a bufio.Scanner
+	long := `{"host":"192.0.2.4","domain":"mx.example.org","padding":"` + strings.Repeat("x", 2*bufio.MaxScanTokenSize) + `"}`
+	if err := processCommand("import-zgrab", bytes.NewBufferString(long), bufio.NewWriter(new(bytes.Buffer))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The grabs of a MX hostname must be adjacent
+	ungrouped := zgrabOutput + `{"host":"192.0.2.2","domain":"mx.example.net"}
+{"host":"192.0.2.3","domain":"mx.example.com"}
+`
+	decoder, _ := NewZgrabDecoder(bytes.NewBufferString(ungrouped))
+	if err := importZgrab(decoder, bufio.NewWriter(new(bytes.Buffer))); err == nil {
+		t.Fatal("ungrouped input accepted")
+	}
+
+	// No TXT records for other ports
+	zgrabPort = portSubmissions
+	defer func() { zgrabPort = portSMTP }()
+	buffer := new(bytes.Buffer)
+	if err := processCommand("import-zgrab", bytes.NewBufferString(zgrabOutput), bufio.NewWriter(buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if result := buffer.String(); result != "" {
+		t.Fatal("unexpected output:", result)
+	}
+}